@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	procSelfCgroup    = "/proc/self/cgroup"
+	procSelfMountInfo = "/proc/self/mountinfo"
+)
+
+// Cgroup locates the cgroup directories of this process, for cgroup v1 or v2.
+// With v1 each controller has its own directory, with v2 all controllers share one.
+type Cgroup struct {
+	Version     int
+	dirs        map[string]string
+	unified     string
+	controllers map[string]bool
+}
+
+type cgroupMount struct {
+	mountPoint string
+	root       string
+}
+
+// DetectCgroup reads the cgroup mounts and membership of this process.
+// v1 is preferred when its cpu or memory controllers are mounted, as in hybrid mode
+// the v2 hierarchy has no controllers.
+func DetectCgroup() (cg *Cgroup, err error) {
+	var v1Mounts map[string]cgroupMount
+	var v2Mount *cgroupMount
+	var v1Paths map[string]string
+	var v2Path string
+
+	v1Mounts, v2Mount, err = parseCgroupMounts(procSelfMountInfo)
+	if err != nil {
+		return
+	}
+	v1Paths, v2Path, err = parseCgroupPaths(procSelfCgroup)
+	if err != nil {
+		return
+	}
+
+	cg = &Cgroup{dirs: map[string]string{}, controllers: map[string]bool{}}
+	for controller, mount := range v1Mounts {
+		if path, ok := v1Paths[controller]; ok {
+			cg.dirs[controller] = resolveCgroupDir(mount, path)
+			cg.controllers[controller] = true
+		}
+	}
+	if len(cg.dirs["cpu"]) > 0 || len(cg.dirs["memory"]) > 0 {
+		cg.Version = 1
+		return
+	}
+	if v2Mount != nil {
+		cg.Version = 2
+		cg.unified = resolveCgroupDir(*v2Mount, v2Path)
+
+		// cpu.stat is always there, other controllers are only enabled for some cgroups
+		cg.controllers["cpu"] = true
+		fields, _ := readCgroupFields(filepath.Join(cg.unified, "cgroup.controllers"))
+		for _, controller := range fields {
+			cg.controllers[controller] = true
+		}
+		return
+	}
+	return nil, fmt.Errorf("no cgroup v1 or v2 hierarchy found")
+}
+
+// Missing returns the controllers that were not found, of those a monitor needs
+func (cg *Cgroup) Missing(controllers ...string) (missing []string) {
+	for _, controller := range controllers {
+		if !cg.controllers[controller] {
+			missing = append(missing, controller)
+		}
+	}
+	return
+}
+
+// Path of a control file, e.g. Path("memory", "memory.stat")
+func (cg *Cgroup) Path(controller, file string) string {
+	if cg.Version == 2 {
+		return filepath.Join(cg.unified, file)
+	}
+	dir, ok := cg.dirs[controller]
+	if !ok {
+		return ""
+	}
+	return filepath.Join(dir, file)
+}
+
+// Join the cgroup path to its mount, relative to the mounted root.
+// Inside a cgroup namespace the path may not exist under the mount, then the mount itself is our cgroup.
+func resolveCgroupDir(mount cgroupMount, path string) string {
+	rel := path
+	if mount.root != "/" {
+		rel = strings.TrimPrefix(path, mount.root)
+	}
+	dir := filepath.Join(mount.mountPoint, rel)
+	if _, err := os.Stat(dir); err != nil {
+		return mount.mountPoint
+	}
+	return dir
+}
+
+// Find cgroup filesystems in mountinfo, v1 mounts are keyed by each controller they hold.
+// Line format: 36 32 0:32 / /sys/fs/cgroup/memory rw,relatime - cgroup cgroup rw,memory
+func parseCgroupMounts(filename string) (v1 map[string]cgroupMount, v2 *cgroupMount, err error) {
+	var f *os.File
+
+	f, err = os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	v1 = map[string]cgroupMount{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || len(fields) < sep+4 {
+			continue
+		}
+		mount := cgroupMount{mountPoint: fields[4], root: fields[3]}
+		switch fields[sep+1] {
+		case "cgroup2":
+			if v2 == nil {
+				v2 = &mount
+			}
+		case "cgroup":
+			for _, opt := range strings.Split(fields[sep+3], ",") {
+				switch opt {
+				case "cpu", "cpuacct", "memory":
+					v1[opt] = mount
+				}
+			}
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// Find our cgroup paths, lines are "hierarchy-ID:controller-list:path", v2 has an empty controller list
+func parseCgroupPaths(filename string) (v1 map[string]string, v2 string, err error) {
+	var f *os.File
+
+	f, err = os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	v1 = map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if len(parts[1]) == 0 {
+			v2 = parts[2]
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			v1[controller] = parts[2]
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// Read a control file holding a single value, "max" means no limit and is returned as ok false
+func readCgroupValue(filename string) (value int64, ok bool, err error) {
+	var b []byte
+
+	b, err = ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	s := strings.TrimSpace(string(b))
+	if s == "max" {
+		return 0, false, nil
+	}
+	value, err = strconv.ParseInt(s, 10, 64)
+	return value, err == nil, err
+}
+
+// Read a control file holding several values on one line, such as cpu.max
+func readCgroupFields(filename string) (fields []string, err error) {
+	var b []byte
+
+	b, err = ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	fields = strings.Fields(string(b))
+	return
+}
+
+// Read a flat keyed control file, such as cpu.stat, memory.stat or memory.events
+func readCgroupKeyValues(filename string) (values map[string]uint64, err error) {
+	var f *os.File
+
+	f, err = os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	values = map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[fields[0]] = value
+	}
+	err = scanner.Err()
+	return
+}
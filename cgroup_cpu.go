@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/cpu"
+)
+
+// CPU use of the container's cgroup, as opposed to CPUSample which covers the host
+type CgroupCPUSample struct {
+	UsageCores       float64 `json:"cgroupCpuUsageCores"`
+	LimitCores       float64 `json:"cgroupCpuLimitCores"`
+	UsedPercent      float64 `json:"cgroupCpuUsedPercent"`
+	Periods          float64 `json:"cgroupCpuPeriods"`
+	ThrottledPeriods float64 `json:"cgroupCpuThrottledPeriods"`
+	ThrottledPercent float64 `json:"cgroupCpuThrottledPercent"`
+	ThrottledSeconds float64 `json:"cgroupCpuThrottledSeconds"`
+}
+
+// Cumulative counters read from the cgroup
+type cgroupCPUStat struct {
+	usage         time.Duration
+	periods       uint64
+	throttled     uint64
+	throttledTime time.Duration
+	time          time.Time
+}
+
+type CgroupCPUMonitor struct {
+	cgroup   *Cgroup
+	last     *cgroupCPUStat
+	cpuCount func(bool) (int, error)
+}
+
+// NewCgroupCPUMonitor fails when the controllers aren't mounted, v1 splits usage into cpuacct
+func NewCgroupCPUMonitor(cgroup *Cgroup) (*CgroupCPUMonitor, error) {
+	controllers := []string{"cpu"}
+	if cgroup.Version == 1 {
+		controllers = append(controllers, "cpuacct")
+	}
+	if missing := cgroup.Missing(controllers...); len(missing) > 0 {
+		return nil, fmt.Errorf("no cgroup %s controller", strings.Join(missing, ", "))
+	}
+	return &CgroupCPUMonitor{cgroup: cgroup, cpuCount: cpu.Counts}, nil
+}
+
+func (cm *CgroupCPUMonitor) Sample() (sample *CgroupCPUSample, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("Panic in CgroupCPUMonitor.Sample: %v\nStack: %s", panicErr, debug.Stack())
+		}
+	}()
+
+	current, err := cm.readStat()
+	if err != nil {
+		return nil, err
+	}
+	if cm.last == nil {
+		cm.last = current
+		return &CgroupCPUSample{}, nil
+	}
+	last := cm.last
+	cm.last = current
+
+	elapsed := current.time.Sub(last.time).Seconds()
+	if elapsed <= 0 {
+		return &CgroupCPUSample{}, nil
+	}
+
+	// Without a quota the container can use every CPU on the host
+	limitCores, ok, err := cm.limit()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		cpus, err := cm.cpuCount(true)
+		if err != nil {
+			return nil, err
+		}
+		limitCores = float64(cpus)
+	}
+
+	sample = &CgroupCPUSample{
+		UsageCores:       (current.usage - last.usage).Seconds() / elapsed,
+		LimitCores:       limitCores,
+		Periods:          float64(current.periods - last.periods),
+		ThrottledPeriods: float64(current.throttled - last.throttled),
+		ThrottledSeconds: (current.throttledTime - last.throttledTime).Seconds(),
+	}
+	if limitCores > 0 {
+		sample.UsedPercent = sample.UsageCores / limitCores * 100.0
+	}
+	if sample.Periods > 0 {
+		sample.ThrottledPercent = sample.ThrottledPeriods / sample.Periods * 100.0
+	}
+	return
+}
+
+// Read usage and throttling counters, v2 keeps both in cpu.stat, v1 splits them between cpuacct and cpu
+func (cm *CgroupCPUMonitor) readStat() (stat *cgroupCPUStat, err error) {
+	var values map[string]uint64
+
+	stat = &cgroupCPUStat{time: time.Now()}
+	values, err = readCgroupKeyValues(cm.cgroup.Path("cpu", "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	stat.periods = values["nr_periods"]
+	stat.throttled = values["nr_throttled"]
+
+	if cm.cgroup.Version == 2 {
+		stat.usage = time.Duration(values["usage_usec"]) * time.Microsecond
+		stat.throttledTime = time.Duration(values["throttled_usec"]) * time.Microsecond
+		return
+	}
+
+	stat.throttledTime = time.Duration(values["throttled_time"])
+	usage, _, err := readCgroupValue(cm.cgroup.Path("cpuacct", "cpuacct.usage"))
+	if err != nil {
+		return nil, err
+	}
+	stat.usage = time.Duration(usage)
+	return
+}
+
+// CPU limit in cores, from cpu.max in v2 ("max 100000" or "50000 100000"),
+// or cpu.cfs_quota_us and cpu.cfs_period_us in v1 (quota -1 is no limit)
+func (cm *CgroupCPUMonitor) limit() (cores float64, ok bool, err error) {
+	var quota, period int64
+
+	if cm.cgroup.Version == 2 {
+		var values []string
+
+		// The root cgroup has no cpu.max
+		values, err = readCgroupFields(cm.cgroup.Path("cpu", "cpu.max"))
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		if err != nil || len(values) != 2 || values[0] == "max" {
+			return
+		}
+		quota, err = strconv.ParseInt(values[0], 10, 64)
+		if err == nil {
+			period, err = strconv.ParseInt(values[1], 10, 64)
+		}
+		if err != nil {
+			return
+		}
+	} else {
+		quota, ok, err = readCgroupValue(cm.cgroup.Path("cpu", "cpu.cfs_quota_us"))
+		if err != nil || !ok || quota < 0 {
+			return 0, false, err
+		}
+		period, ok, err = readCgroupValue(cm.cgroup.Path("cpu", "cpu.cfs_period_us"))
+		if err != nil || !ok {
+			return 0, false, err
+		}
+	}
+	if quota <= 0 || period <= 0 {
+		return 0, false, nil
+	}
+	return float64(quota) / float64(period), true, nil
+}
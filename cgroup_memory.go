@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+
+	"github.com/shirou/gopsutil/mem"
+)
+
+// cgroup v1 reports no limit as a huge page-aligned value, rather than "max"
+const cgroupV1NoLimit = 1 << 62
+
+// Memory use of the container's cgroup, event counts are for the last poll interval
+type CgroupMemorySample struct {
+	LimitBytes        float64 `json:"cgroupMemoryLimitBytes"`
+	UsageBytes        float64 `json:"cgroupMemoryUsageBytes"`
+	WorkingSetBytes   float64 `json:"cgroupMemoryWorkingSetBytes"`
+	AnonBytes         float64 `json:"cgroupMemoryAnonBytes"`
+	FileBytes         float64 `json:"cgroupMemoryFileBytes"`
+	ActiveFileBytes   float64 `json:"cgroupMemoryActiveFileBytes"`
+	InactiveFileBytes float64 `json:"cgroupMemoryInactiveFileBytes"`
+	OomEvents         float64 `json:"cgroupMemoryOomEvents"`
+	OomKillEvents     float64 `json:"cgroupMemoryOomKillEvents"`
+	HighEvents        float64 `json:"cgroupMemoryHighEvents"`
+	MaxEvents         float64 `json:"cgroupMemoryMaxEvents"`
+}
+
+// Values read from the cgroup, v1 names are mapped to their v2 equivalents
+type cgroupMemoryStat struct {
+	limit        uint64
+	limited      bool
+	usage        uint64
+	anon         uint64
+	file         uint64
+	activeFile   uint64
+	inactiveFile uint64
+	shmem        uint64
+	events       map[string]uint64
+}
+
+type CgroupMemoryMonitor struct {
+	cgroup      *Cgroup
+	lastEvents  map[string]uint64
+	hostHarvest func() (*mem.VirtualMemoryStat, error)
+	readFailed  bool
+}
+
+// NewCgroupMemoryMonitor returns a monitor for the container's memory, hostHarvest reads
+// the host memory for when the cgroup has no limit
+func NewCgroupMemoryMonitor(cgroup *Cgroup, hostHarvest func() (*mem.VirtualMemoryStat, error)) (*CgroupMemoryMonitor, error) {
+	if missing := cgroup.Missing("memory"); len(missing) > 0 {
+		return nil, fmt.Errorf("no cgroup %s controller", strings.Join(missing, ", "))
+	}
+	return &CgroupMemoryMonitor{cgroup: cgroup, hostHarvest: hostHarvest}, nil
+}
+
+func (cm *CgroupMemoryMonitor) Sample() (sample *CgroupMemorySample, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("Panic in CgroupMemoryMonitor.Sample: %v\nStack: %s", panicErr, debug.Stack())
+		}
+	}()
+
+	stat, err := cm.readStat()
+	if err != nil {
+		return nil, err
+	}
+	host, err := cm.hostHarvest()
+	if err != nil {
+		return nil, err
+	}
+
+	sample = &CgroupMemorySample{
+		LimitBytes:        float64(effectiveLimit(stat, host)),
+		UsageBytes:        float64(stat.usage),
+		WorkingSetBytes:   float64(workingSet(stat)),
+		AnonBytes:         float64(stat.anon),
+		FileBytes:         float64(stat.file),
+		ActiveFileBytes:   float64(stat.activeFile),
+		InactiveFileBytes: float64(stat.inactiveFile),
+	}
+
+	// Events are cumulative, report the change since the last sample
+	if cm.lastEvents != nil {
+		sample.OomEvents = eventDelta(stat.events, cm.lastEvents, "oom")
+		sample.OomKillEvents = eventDelta(stat.events, cm.lastEvents, "oom_kill")
+		sample.HighEvents = eventDelta(stat.events, cm.lastEvents, "high")
+		sample.MaxEvents = eventDelta(stat.events, cm.lastEvents, "max")
+	}
+	cm.lastEvents = stat.events
+	return
+}
+
+// VirtualMemory is a MemoryMonitor vmHarvest that reports memory against the cgroup limit,
+// or the host memory when the cgroup has no limit below it or can't be read
+func (cm *CgroupMemoryMonitor) VirtualMemory() (*mem.VirtualMemoryStat, error) {
+	host, err := cm.hostHarvest()
+	if err != nil {
+		return nil, err
+	}
+	stat, err := cm.readStat()
+	if err != nil {
+		// Log once until the cgroup can be read again
+		if !cm.readFailed {
+			log.Printf("Error: cgroup memory unreadable, reporting host memory %v", err)
+			cm.readFailed = true
+		}
+		return host, nil
+	}
+	cm.readFailed = false
+	if !stat.limited || stat.limit >= host.Total {
+		return host, nil
+	}
+
+	used := workingSet(stat)
+	if used > stat.limit {
+		used = stat.limit
+	}
+	return &mem.VirtualMemoryStat{
+		Total:     stat.limit,
+		Available: stat.limit - used,
+		Free:      stat.limit - used,
+		Used:      used,
+		Cached:    stat.file,
+		Shared:    stat.shmem,
+	}, nil
+}
+
+// Working set is usage less the page cache that can be reclaimed without swapping
+func workingSet(stat *cgroupMemoryStat) uint64 {
+	if stat.inactiveFile > stat.usage {
+		return 0
+	}
+	return stat.usage - stat.inactiveFile
+}
+
+func effectiveLimit(stat *cgroupMemoryStat, host *mem.VirtualMemoryStat) uint64 {
+	if !stat.limited || stat.limit > host.Total {
+		return host.Total
+	}
+	return stat.limit
+}
+
+func eventDelta(current, last map[string]uint64, key string) float64 {
+	if current[key] < last[key] {
+		return 0
+	}
+	return float64(current[key] - last[key])
+}
+
+// Read the memory controller files, memory.max, memory.current, memory.stat and memory.events in v2,
+// or memory.limit_in_bytes, memory.usage_in_bytes, memory.stat, memory.oom_control and memory.failcnt in v1
+func (cm *CgroupMemoryMonitor) readStat() (stat *cgroupMemoryStat, err error) {
+	var limit, usage int64
+	var values map[string]uint64
+
+	stat = &cgroupMemoryStat{events: map[string]uint64{}}
+	if cm.cgroup.Version == 2 {
+		// The root cgroup has no memory.max
+		limit, stat.limited, _ = readCgroupValue(cm.cgroup.Path("memory", "memory.max"))
+		usage, _, err = readCgroupValue(cm.cgroup.Path("memory", "memory.current"))
+		if err != nil {
+			return nil, err
+		}
+		values, err = readCgroupKeyValues(cm.cgroup.Path("memory", "memory.stat"))
+		if err != nil {
+			return nil, err
+		}
+		stat.anon = values["anon"]
+		stat.file = values["file"]
+		stat.activeFile = values["active_file"]
+		stat.inactiveFile = values["inactive_file"]
+		stat.shmem = values["shmem"]
+
+		stat.events, err = readCgroupKeyValues(cm.cgroup.Path("memory", "memory.events"))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		limit, stat.limited, err = readCgroupValue(cm.cgroup.Path("memory", "memory.limit_in_bytes"))
+		if err != nil {
+			return nil, err
+		}
+		stat.limited = stat.limited && limit < cgroupV1NoLimit
+		usage, _, err = readCgroupValue(cm.cgroup.Path("memory", "memory.usage_in_bytes"))
+		if err != nil {
+			return nil, err
+		}
+		// total_ values include child cgroups, like the v2 values do
+		values, err = readCgroupKeyValues(cm.cgroup.Path("memory", "memory.stat"))
+		if err != nil {
+			return nil, err
+		}
+		stat.anon = values["total_rss"]
+		stat.file = values["total_cache"]
+		stat.activeFile = values["total_active_file"]
+		stat.inactiveFile = values["total_inactive_file"]
+		stat.shmem = values["total_shmem"]
+
+		// v1 has no oom or high events, failcnt counts hitting the limit
+		values, err = readCgroupKeyValues(cm.cgroup.Path("memory", "memory.oom_control"))
+		if err != nil {
+			return nil, err
+		}
+		stat.events["oom_kill"] = values["oom_kill"]
+		failcnt, _, err := readCgroupValue(cm.cgroup.Path("memory", "memory.failcnt"))
+		if err != nil {
+			return nil, err
+		}
+		stat.events["max"] = uint64(failcnt)
+	}
+	if limit > 0 {
+		stat.limit = uint64(limit)
+	}
+	if usage > 0 {
+		stat.usage = uint64(usage)
+	}
+	return
+}
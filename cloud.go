@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultAwsMetadataURL   = "http://169.254.169.254"
+	DefaultGcpMetadataURL   = "http://metadata.google.internal"
+	DefaultAzureMetadataURL = "http://169.254.169.254"
+	CloudMetadataTimeout    = time.Second
+	CloudRefreshInterval    = time.Hour
+	awsTokenTTLSeconds      = "21600"
+	azureApiVersion         = "2021-02-01"
+
+	CloudAWS   = "aws"
+	CloudGCP   = "gcp"
+	CloudAzure = "azure"
+)
+
+// Instance metadata, as sent in the common attributes
+type CloudInstance struct {
+	Provider         string
+	Region           string
+	AvailabilityZone string
+	InstanceId       string
+	InstanceType     string
+	AccountId        string
+}
+
+// CloudMetadata adds the cloud provider's instance metadata to the common attributes.
+// The provider is detected once at startup, and its metadata refreshed every hour.
+type CloudMetadata struct {
+	client      *http.Client
+	endpoints   map[string]string
+	provider    string
+	attributes  map[string]string
+	lastRefresh time.Time
+}
+
+// Providers in the order they are detected, as they may all answer on 169.254.169.254
+var cloudProviders = []struct {
+	name  string
+	query func(cm *CloudMetadata, endpoint string) (*CloudInstance, error)
+}{
+	{CloudAWS, (*CloudMetadata).queryAws},
+	{CloudGCP, (*CloudMetadata).queryGcp},
+	{CloudAzure, (*CloudMetadata).queryAzure},
+}
+
+// NewCloudMetadata finds which provider's metadata service answers, or only asks the configured provider.
+// Requests time out quickly, so startup is not held up where there is no metadata service.
+func NewCloudMetadata(data *ConfigData) (cm *CloudMetadata, err error) {
+	cm = &CloudMetadata{
+		client: &http.Client{Timeout: CloudMetadataTimeout},
+		endpoints: map[string]string{
+			CloudAWS:   strings.TrimSuffix(data.CloudAwsURL, "/"),
+			CloudGCP:   strings.TrimSuffix(data.CloudGcpURL, "/"),
+			CloudAzure: strings.TrimSuffix(data.CloudAzureURL, "/"),
+		},
+	}
+
+	// Ask every provider at once, so detection takes one timeout rather than one each
+	type result struct {
+		instance *CloudInstance
+		err      error
+	}
+	results := make([]chan result, len(cloudProviders))
+	for i, p := range cloudProviders {
+		results[i] = make(chan result, 1)
+		if len(data.CloudProvider) > 0 && data.CloudProvider != p.name {
+			results[i] <- result{err: fmt.Errorf("not configured")}
+			continue
+		}
+		go func(i int, query func(*CloudMetadata, string) (*CloudInstance, error), endpoint string) {
+			instance, err := query(cm, endpoint)
+			results[i] <- result{instance, err}
+		}(i, p.query, cm.endpoints[p.name])
+	}
+
+	var errs []string
+	for i, p := range cloudProviders {
+		r := <-results[i]
+		if r.err != nil {
+			errs = append(errs, fmt.Sprintf("%s %v", p.name, r.err))
+			continue
+		}
+		if len(cm.provider) == 0 {
+			cm.provider = p.name
+			cm.setInstance(r.instance)
+		}
+	}
+	if len(cm.provider) == 0 {
+		return nil, fmt.Errorf("no instance metadata service found: %s", strings.Join(errs, ", "))
+	}
+	return
+}
+
+// Attributes are refreshed when stale, keeping the cached values if the metadata service can't be reached
+func (cm *CloudMetadata) Attributes() map[string]string {
+	if time.Since(cm.lastRefresh) < CloudRefreshInterval {
+		return cm.attributes
+	}
+	for _, p := range cloudProviders {
+		if p.name != cm.provider {
+			continue
+		}
+		instance, err := p.query(cm, cm.endpoints[p.name])
+		if err != nil {
+			log.Printf("Error: cloud metadata %s %v", p.name, err)
+			// Try again next hour, rather than every poll
+			cm.lastRefresh = time.Now()
+			break
+		}
+		cm.setInstance(instance)
+	}
+	return cm.attributes
+}
+
+func (cm *CloudMetadata) setInstance(instance *CloudInstance) {
+	cm.attributes = map[string]string{}
+	setAttribute(cm.attributes, "cloud.provider", instance.Provider)
+	setAttribute(cm.attributes, "cloud.region", instance.Region)
+	setAttribute(cm.attributes, "cloud.availabilityZone", instance.AvailabilityZone)
+	setAttribute(cm.attributes, "instanceId", instance.InstanceId)
+	setAttribute(cm.attributes, "instanceType", instance.InstanceType)
+	setAttribute(cm.attributes, "accountId", instance.AccountId)
+	cm.lastRefresh = time.Now()
+}
+
+// Make a metadata request, returning the body of a 200 response
+func (cm *CloudMetadata) request(method, address string, headers map[string]string) (b []byte, err error) {
+	var req *http.Request
+	var res *http.Response
+
+	req, err = http.NewRequest(method, address, nil)
+	if err != nil {
+		return
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err = cm.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	b, err = ioutil.ReadAll(res.Body)
+	if err == nil && res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s http status %d", address, res.StatusCode)
+	}
+	return
+}
+
+// AWS IMDSv2: get a session token, then the instance identity document with it.
+// When the service refuses a token, as when only IMDSv1 is enabled, try without one.
+func (cm *CloudMetadata) queryAws(endpoint string) (instance *CloudInstance, err error) {
+	var b []byte
+
+	headers := map[string]string{}
+	b, err = cm.request(http.MethodPut, endpoint+"/latest/api/token", map[string]string{
+		"X-aws-ec2-metadata-token-ttl-seconds": awsTokenTTLSeconds,
+	})
+	if _, unreachable := err.(*url.Error); unreachable {
+		// No service answered, don't wait for a second timeout
+		return
+	} else if err == nil {
+		headers["X-aws-ec2-metadata-token"] = strings.TrimSpace(string(b))
+	}
+	b, err = cm.request(http.MethodGet, endpoint+"/latest/dynamic/instance-identity/document", headers)
+	if err != nil {
+		return
+	}
+
+	document := struct {
+		AccountId        string `json:"accountId"`
+		AvailabilityZone string `json:"availabilityZone"`
+		Region           string `json:"region"`
+		InstanceId       string `json:"instanceId"`
+		InstanceType     string `json:"instanceType"`
+	}{}
+	err = json.Unmarshal(b, &document)
+	if err != nil {
+		return
+	}
+	if len(document.InstanceId) == 0 {
+		return nil, fmt.Errorf("no instanceId in identity document")
+	}
+	instance = &CloudInstance{
+		Provider:         CloudAWS,
+		Region:           document.Region,
+		AvailabilityZone: document.AvailabilityZone,
+		InstanceId:       document.InstanceId,
+		InstanceType:     document.InstanceType,
+		AccountId:        document.AccountId,
+	}
+	return
+}
+
+// GCP: the instance, with zone and machine type as paths like "projects/123/zones/us-central1-a",
+// and the project ID as the account
+func (cm *CloudMetadata) queryGcp(endpoint string) (instance *CloudInstance, err error) {
+	var b, project []byte
+
+	headers := map[string]string{"Metadata-Flavor": "Google"}
+	b, err = cm.request(http.MethodGet, endpoint+"/computeMetadata/v1/instance/?recursive=true", headers)
+	if err != nil {
+		return
+	}
+	project, err = cm.request(http.MethodGet, endpoint+"/computeMetadata/v1/project/project-id", headers)
+	if err != nil {
+		return
+	}
+
+	document := struct {
+		Id          json.Number `json:"id"`
+		MachineType string      `json:"machineType"`
+		Zone        string      `json:"zone"`
+	}{}
+	err = json.Unmarshal(b, &document)
+	if err != nil {
+		return
+	}
+	if len(document.Id) == 0 {
+		return nil, fmt.Errorf("no id in instance metadata")
+	}
+	zone := lastPathElement(document.Zone)
+	instance = &CloudInstance{
+		Provider:         CloudGCP,
+		AvailabilityZone: zone,
+		InstanceId:       document.Id.String(),
+		InstanceType:     lastPathElement(document.MachineType),
+		AccountId:        strings.TrimSpace(string(project)),
+	}
+	// Zones are the region with a suffix, us-central1-a is in us-central1
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		instance.Region = zone[:i]
+	}
+	return
+}
+
+// Azure: the compute section of the instance metadata, the zone is empty outside availability zones
+func (cm *CloudMetadata) queryAzure(endpoint string) (instance *CloudInstance, err error) {
+	var b []byte
+
+	b, err = cm.request(http.MethodGet, endpoint+"/metadata/instance?api-version="+azureApiVersion, map[string]string{
+		"Metadata": "true",
+	})
+	if err != nil {
+		return
+	}
+
+	document := struct {
+		Compute struct {
+			Location       string `json:"location"`
+			Zone           string `json:"zone"`
+			VmId           string `json:"vmId"`
+			VmSize         string `json:"vmSize"`
+			SubscriptionId string `json:"subscriptionId"`
+		} `json:"compute"`
+	}{}
+	err = json.Unmarshal(b, &document)
+	if err != nil {
+		return
+	}
+	if len(document.Compute.VmId) == 0 {
+		return nil, fmt.Errorf("no vmId in instance metadata")
+	}
+	instance = &CloudInstance{
+		Provider:         CloudAzure,
+		Region:           document.Compute.Location,
+		AvailabilityZone: document.Compute.Zone,
+		InstanceId:       document.Compute.VmId,
+		InstanceType:     document.Compute.VmSize,
+		AccountId:        document.Compute.SubscriptionId,
+	}
+	return
+}
+
+func lastPathElement(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
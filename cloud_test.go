@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const imdsTestToken = "AQAEAFTOKEN"
+
+// An instance metadata service stand-in for one provider
+type imdsStub struct {
+	mu           sync.Mutex
+	provider     string
+	v1Only       bool
+	instanceType string
+	fail         bool
+	tokenless    int
+}
+
+func (stub *imdsStub) setInstanceType(instanceType string, fail bool) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	stub.instanceType = instanceType
+	stub.fail = fail
+}
+
+func (stub *imdsStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	if stub.fail {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	switch stub.provider {
+	case CloudAWS:
+		stub.serveAws(w, r)
+	case CloudGCP:
+		stub.serveGcp(w, r)
+	case CloudAzure:
+		stub.serveAzure(w, r)
+	}
+}
+
+// IMDSv2 requires a token from a PUT, unless v1 is all that's available
+func (stub *imdsStub) serveAws(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/latest/api/token" && !stub.v1Only:
+		if r.Method != http.MethodPut || len(r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds")) == 0 {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, imdsTestToken)
+	case r.URL.Path == "/latest/dynamic/instance-identity/document" && r.Method == http.MethodGet:
+		token := r.Header.Get("X-aws-ec2-metadata-token")
+		if len(token) == 0 {
+			stub.tokenless++
+		}
+		if !stub.v1Only && token != imdsTestToken {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{
+			"accountId": "123456789012",
+			"architecture": "x86_64",
+			"availabilityZone": "us-east-1b",
+			"imageId": "ami-0123456789abcdef0",
+			"instanceId": "i-0123456789abcdef0",
+			"instanceType": "%s",
+			"privateIp": "10.0.0.12",
+			"region": "us-east-1"
+		}`, stub.instanceType)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (stub *imdsStub) serveGcp(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Metadata-Flavor") != "Google" {
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case "/computeMetadata/v1/instance/":
+		if r.URL.Query().Get("recursive") != "true" {
+			http.NotFound(w, r)
+			return
+		}
+		// The ID is a number too large for a float64
+		fmt.Fprintf(w, `{
+			"id": 4520031799277581759,
+			"machineType": "projects/123456789012/machineTypes/%s",
+			"name": "web-1",
+			"zone": "projects/123456789012/zones/europe-west1-b"
+		}`, stub.instanceType)
+	case "/computeMetadata/v1/project/project-id":
+		fmt.Fprint(w, "my-project")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (stub *imdsStub) serveAzure(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Metadata") != "true" || r.URL.Path != "/metadata/instance" || r.URL.Query().Get("api-version") != azureApiVersion {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"compute": map[string]string{
+			"location":       "westeurope",
+			"zone":           "2",
+			"vmId":           "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+			"vmSize":         stub.instanceType,
+			"subscriptionId": "8d10da13-8125-4ba9-a717-bf7490507b3d",
+		},
+	})
+}
+
+func newImdsStub(t *testing.T, provider, instanceType string) (*imdsStub, string) {
+	stub := &imdsStub{provider: provider, instanceType: instanceType}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	return stub, server.URL
+}
+
+// An endpoint that refuses connections, as when there is no metadata service
+func unreachableURL(t *testing.T) string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return server.URL
+}
+
+func cloudTestConfig(t *testing.T) *ConfigData {
+	return &ConfigData{
+		CloudAwsURL:   unreachableURL(t),
+		CloudGcpURL:   unreachableURL(t),
+		CloudAzureURL: unreachableURL(t),
+	}
+}
+
+func TestCloudMetadataAws(t *testing.T) {
+	for _, v1Only := range []bool{false, true} {
+		stub, url := newImdsStub(t, CloudAWS, "m5.large")
+		stub.v1Only = v1Only
+		data := cloudTestConfig(t)
+		data.CloudAwsURL = url + "/"
+
+		cm, err := NewCloudMetadata(data)
+		if err != nil {
+			t.Fatalf("v1Only %v: %v", v1Only, err)
+		}
+		want := map[string]string{
+			"cloud.provider":         "aws",
+			"cloud.region":           "us-east-1",
+			"cloud.availabilityZone": "us-east-1b",
+			"instanceId":             "i-0123456789abcdef0",
+			"instanceType":           "m5.large",
+			"accountId":              "123456789012",
+		}
+		if got := cm.Attributes(); !reflect.DeepEqual(got, want) {
+			t.Errorf("v1Only %v: attributes %v, want %v", v1Only, got, want)
+		}
+		// The document is only read without a token when IMDSv2 isn't available
+		if v1Only != (stub.tokenless > 0) {
+			t.Errorf("v1Only %v: %d requests without a token", v1Only, stub.tokenless)
+		}
+	}
+}
+
+func TestCloudMetadataGcp(t *testing.T) {
+	_, url := newImdsStub(t, CloudGCP, "e2-medium")
+	data := cloudTestConfig(t)
+	data.CloudGcpURL = url
+
+	cm, err := NewCloudMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"cloud.provider":         "gcp",
+		"cloud.region":           "europe-west1",
+		"cloud.availabilityZone": "europe-west1-b",
+		"instanceId":             "4520031799277581759",
+		"instanceType":           "e2-medium",
+		"accountId":              "my-project",
+	}
+	if got := cm.Attributes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("attributes %v, want %v", got, want)
+	}
+}
+
+func TestCloudMetadataAzure(t *testing.T) {
+	_, url := newImdsStub(t, CloudAzure, "Standard_D2s_v3")
+	data := cloudTestConfig(t)
+	data.CloudAzureURL = url
+
+	cm, err := NewCloudMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"cloud.provider":         "azure",
+		"cloud.region":           "westeurope",
+		"cloud.availabilityZone": "2",
+		"instanceId":             "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+		"instanceType":           "Standard_D2s_v3",
+		"accountId":              "8d10da13-8125-4ba9-a717-bf7490507b3d",
+	}
+	if got := cm.Attributes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("attributes %v, want %v", got, want)
+	}
+}
+
+// AWS and Azure share 169.254.169.254, a configured provider skips asking the others
+func TestCloudMetadataProvider(t *testing.T) {
+	_, awsURL := newImdsStub(t, CloudAWS, "m5.large")
+	_, azureURL := newImdsStub(t, CloudAzure, "Standard_D2s_v3")
+	data := cloudTestConfig(t)
+	data.CloudAwsURL = awsURL
+	data.CloudAzureURL = azureURL
+
+	cm, err := NewCloudMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider := cm.Attributes()["cloud.provider"]; provider != CloudAWS {
+		t.Errorf("detected %s, want aws first", provider)
+	}
+
+	data.CloudProvider = CloudAzure
+	cm, err = NewCloudMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider := cm.Attributes()["cloud.provider"]; provider != CloudAzure {
+		t.Errorf("detected %s, want the configured azure", provider)
+	}
+
+	data.CloudProvider = CloudGCP
+	if _, err = NewCloudMetadata(data); err == nil {
+		t.Error("no error when the configured provider doesn't answer")
+	}
+}
+
+func TestCloudMetadataNotFound(t *testing.T) {
+	// A metadata address that never answers, as on a network that drops the packets
+	hang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(hang.Close)
+	data := cloudTestConfig(t)
+	data.CloudAwsURL = hang.URL
+	data.CloudAzureURL = hang.URL
+
+	start := time.Now()
+	cm, err := NewCloudMetadata(data)
+	if err == nil || cm != nil {
+		t.Fatalf("detected %v without a metadata service", cm)
+	}
+	// Providers are asked at once, so detection takes one timeout rather than one each
+	if elapsed := time.Since(start); elapsed > CloudMetadataTimeout+CloudMetadataTimeout/2 {
+		t.Errorf("detection took %v, timeout is %v", elapsed, CloudMetadataTimeout)
+	}
+}
+
+func TestCloudMetadataRefresh(t *testing.T) {
+	stub, url := newImdsStub(t, CloudAWS, "m5.large")
+	data := cloudTestConfig(t)
+	data.CloudAwsURL = url
+
+	cm, err := NewCloudMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cached until the refresh interval passes
+	stub.setInstanceType("m5.xlarge", false)
+	if got := cm.Attributes()["instanceType"]; got != "m5.large" {
+		t.Errorf("instanceType %s before refresh, want cached m5.large", got)
+	}
+	cm.lastRefresh = time.Now().Add(-CloudRefreshInterval)
+	if got := cm.Attributes()["instanceType"]; got != "m5.xlarge" {
+		t.Errorf("instanceType %s after refresh, want m5.xlarge", got)
+	}
+
+	// A failed refresh keeps the last values, and waits for the next interval
+	stub.setInstanceType("m5.2xlarge", true)
+	cm.lastRefresh = time.Now().Add(-CloudRefreshInterval)
+	got := cm.Attributes()
+	if got["instanceType"] != "m5.xlarge" || got["cloud.provider"] != CloudAWS || len(got) != 6 {
+		t.Errorf("attributes %v after failed refresh, want the cached ones", got)
+	}
+	if time.Since(cm.lastRefresh) > time.Minute {
+		t.Error("failed refresh is retried every poll")
+	}
+}
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
 const (
@@ -15,19 +25,114 @@ const (
 	DefaultWorkloadName = "My Workload"
 	DefaultPrefix       = "container"
 	DefaultLogfile      = "./infra-lite.log"
+	DefaultConfigFile   = "./infra-lite.yml"
+	DefaultSpoolDir     = "./infra-lite-spool"
+	DefaultSpoolMaxSize = 10 * 1024 * 1024
+	DefaultSpoolMaxAge  = "24h"
+	DefaultUsageTimeout = "5s"
 	NrMetricApi         = "https://metric-api.newrelic.com/metric/v1"
+	NrMetricApiEU       = "https://metric-api.eu.newrelic.com/metric/v1"
+	NrMetricApiFedRAMP  = "https://gov-metric-api.newrelic.com/metric/v1"
+	RegionUS            = "US"
+	RegionEU            = "EU"
+	RegionFedRAMP       = "FedRAMP"
 )
 
+// Metric API endpoint for each New Relic region
+var regionMetricApi = map[string]string{
+	RegionUS:      NrMetricApi,
+	RegionEU:      NrMetricApiEU,
+	RegionFedRAMP: NrMetricApiFedRAMP,
+}
+
+// Attribute names used by infra-lite itself, which custom attributes can't override
+var reservedAttributes = map[string]bool{
+	"workload":        true,
+	"service":         true,
+	"hostname":        true,
+	"mountPoint":      true,
+	"device":          true,
+	"isReadOnly":      true,
+	"fileSystemType":  true,
+	"interfaceName":   true,
+	"hardwareAddress": true,
+	"ipV4Address":     true,
+	"ipV6Address":     true,
+	"state":           true,
+	"cpu":             true,
+	"resource":        true,
+	"stall":           true,
+	"scope":           true,
+	"pid":             true,
+	"processName":     true,
+	"commandLine":     true,
+	"user":            true,
+	"watchName":       true,
+	"port":            true,
+	"status":          true,
+	"containerId":     true,
+	"containerName":   true,
+	"containerImage":  true,
+}
+
+// Metrics that are only sent when enabled in config
+var defaultDisabledMetrics = map[string]bool{
+	"CpuNicePercent":    true,
+	"CpuIrqPercent":     true,
+	"CpuSoftirqPercent": true,
+	"CpuGuestPercent":   true,
+}
+
 // To store configuration
 type ConfigData struct {
-	LicenseKey   string `json:"license_key"`
-	PollInterval time.Duration
-	Hostname     string
-	Service      string
-	Workload     string
-	Prefix       string
-	Logfile      string
-	SampleTime   int64
+	LicenseKey       string               `json:"license_key" yaml:"license_key"`
+	PollInterval     time.Duration        `yaml:"poll_interval"`
+	Hostname         string               `yaml:"hostname"`
+	Service          string               `yaml:"app_name"`
+	Workload         string               `yaml:"workload_name"`
+	Prefix           string               `yaml:"metric_prefix"`
+	Logfile          string               `yaml:"log_file"`
+	Verbose          bool                 `yaml:"verbose"`
+	Region           string               `yaml:"region"`
+	MetricApi        string               `yaml:"metric_endpoint"`
+	SpoolDir         string               `yaml:"spool_dir"`
+	SpoolMaxBytes    int64                `yaml:"spool_max_bytes"`
+	SpoolMaxAge      time.Duration        `yaml:"spool_max_age"`
+	CustomAttributes map[string]string    `yaml:"custom_attributes"`
+	Metrics          map[string]bool      `yaml:"metrics"`
+	PerCPU           bool                 `yaml:"per_cpu"`
+	CgroupMetrics    bool                 `yaml:"cgroup_metrics"`
+	ProcessMetrics   bool                 `yaml:"process_metrics"`
+	ProcessTopN      int                  `yaml:"process_top_n"`
+	ProcessWatch     []ProcessWatchConfig `yaml:"process_watch"`
+	NetworkInclude   []string             `yaml:"network_interface_include"`
+	NetworkExclude   []string             `yaml:"network_interface_exclude"`
+	NetworkSkipDown  bool                 `yaml:"network_skip_down"`
+	NetworkSkipNoIP  bool                 `yaml:"network_skip_no_address"`
+	SocketMetrics    bool                 `yaml:"socket_metrics"`
+	SocketPorts      []int                `yaml:"socket_ports"`
+	ProtocolMetrics  bool                 `yaml:"protocol_metrics"`
+	ProtocolCounters []string             `yaml:"protocol_counters"`
+	StorageFsTypes   []string             `yaml:"storage_filesystems"`
+	StorageInclude   []string             `yaml:"storage_mount_include"`
+	StorageExclude   []string             `yaml:"storage_mount_exclude"`
+	StorageTimeout   time.Duration        `yaml:"storage_usage_timeout"`
+	HostRoot         string               `yaml:"host_root"`
+	DockerMetrics    bool                 `yaml:"docker_metrics"`
+	DockerSocket     string               `yaml:"docker_socket"`
+	K8sMetadata      bool                 `yaml:"k8s_metadata"`
+	K8sPodInfoDir    string               `yaml:"k8s_podinfo_dir"`
+	K8sAnnotations   []string             `yaml:"k8s_annotations"`
+	K8sKubelet       bool                 `yaml:"k8s_kubelet"`
+	K8sKubeletURL    string               `yaml:"k8s_kubelet_url"`
+	K8sSkipVerify    bool                 `yaml:"k8s_kubelet_insecure"`
+	CloudMetadata    bool                 `yaml:"cloud_metadata"`
+	CloudProvider    string               `yaml:"cloud_provider"`
+	CloudAwsURL      string               `yaml:"cloud_aws_endpoint"`
+	CloudGcpURL      string               `yaml:"cloud_gcp_endpoint"`
+	CloudAzureURL    string               `yaml:"cloud_azure_endpoint"`
+	SampleTime       int64                `yaml:"-"`
+	enrichers        []AttributeEnricher
 }
 
 var DebugLog bool
@@ -51,33 +156,250 @@ func validateFile(file string) (err error) {
 	return
 }
 
-func (data *ConfigData) initConfig() {
+func validateDir(dir string) (err error) {
+	var dirInfo os.FileInfo
+
+	dirInfo, err = os.Stat(dir)
+	if os.IsNotExist(err) {
+		err = fmt.Errorf("invalid, no such directory [%s]", dir)
+	} else if err != nil {
+		err = fmt.Errorf("invalid, %v [%s]", err, dir)
+	} else if !dirInfo.IsDir() {
+		err = fmt.Errorf("invalid, not a directory [%s]", dir)
+	}
+	return
+}
+
+// Read settings from a YAML config file, if one was given or the default is present
+func (data *ConfigData) readConfigFile() (file string, err error) {
+	var b []byte
+
+	// Command line flag takes priority over env var
+	flag.StringVar(&file, "config", "", "path to YAML config file")
+	flag.Parse()
+	if len(file) == 0 {
+		file = os.Getenv("NRIA_CONFIG_FILE")
+	}
+	if len(file) == 0 {
+		// Default config file is optional
+		if _, err = os.Stat(DefaultConfigFile); err != nil {
+			return "", nil
+		}
+		file = DefaultConfigFile
+	}
+
+	err = validateFile(file)
+	if err != nil {
+		return
+	}
+	b, err = ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	err = yaml.UnmarshalStrict(b, data)
+	return
+}
+
+// Point gopsutil and the agent helpers at the host's /proc, /sys and /etc under the host root,
+// unless HOST_PROC, HOST_SYS or HOST_ETC are already set
+func (data *ConfigData) initHostRoot() (err error) {
+	if len(data.HostRoot) == 0 {
+		return
+	}
+	if err = validateDir(data.HostRoot); err != nil {
+		return fmt.Errorf("host_root %v", err)
+	}
+	for _, env := range []struct{ name, dir string }{
+		{"HOST_PROC", "proc"},
+		{"HOST_SYS", "sys"},
+		{"HOST_ETC", "etc"},
+	} {
+		if len(os.Getenv(env.name)) > 0 {
+			continue
+		}
+		if err = os.Setenv(env.name, filepath.Join(data.HostRoot, env.dir)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Override a setting with the env var, if present
+func envString(name string, value *string) {
+	if env := os.Getenv(name); len(env) > 0 {
+		*value = env
+	}
+}
+
+// Override a boolean setting with the env var, if present, any value other than "0" is true
+func envBool(name string, value *bool) {
+	if env, ok := os.LookupEnv(name); ok {
+		*value = len(env) > 0 && env != "0"
+	}
+}
+
+// Override a duration setting with the env var, if present
+func envDuration(name string, value *time.Duration) {
 	var err error
-	var logfile *os.File
 
-	// Get license key
-	data.LicenseKey = os.Getenv("NEW_RELIC_LICENSE_KEY")
-	if len(data.LicenseKey) == 0 {
-		log.Fatal("Error: could not locate env var NEW_RELIC_LICENSE_KEY")
+	if env := os.Getenv(name); len(env) > 0 {
+		*value, err = time.ParseDuration(env)
+		if err != nil {
+			log.Fatalf("Error: could not parse env var %s: %s, must be a duration (ex: 1h)", name, err)
+		}
+	}
+}
+
+// Override a numeric setting with the env var, if present
+func envInt64(name string, value *int64) {
+	var err error
+
+	if env := os.Getenv(name); len(env) > 0 {
+		*value, err = strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			log.Fatalf("Error: could not parse env var %s: %s, must be an integer", name, err)
+		}
+	}
+}
+
+// Override an int setting with the env var, if present
+func envInt(name string, value *int) {
+	var err error
+
+	if env := os.Getenv(name); len(env) > 0 {
+		*value, err = strconv.Atoi(env)
+		if err != nil {
+			log.Fatalf("Error: could not parse env var %s: %s, must be an integer", name, err)
+		}
+	}
+}
+
+// Override a list setting with the comma separated env var, if present
+func envList(name string, value *[]string) {
+	if env := os.Getenv(name); len(env) > 0 {
+		*value = nil
+		for _, item := range strings.Split(env, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				*value = append(*value, item)
+			}
+		}
+	}
+}
+
+// Override a list of ints with the comma separated env var, if present
+func envIntList(name string, value *[]int) {
+	var items []string
+
+	envList(name, &items)
+	if len(items) == 0 {
+		return
+	}
+	*value = nil
+	for _, item := range items {
+		i, err := strconv.Atoi(item)
+		if err != nil {
+			log.Fatalf("Error: could not parse env var %s: %s, must be a list of integers", name, err)
+		}
+		*value = append(*value, i)
+	}
+}
+
+// Check every pattern in a list is a valid glob
+func validatePatterns(name string, patterns []string) (err error) {
+	for _, pattern := range patterns {
+		if _, err = filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s pattern [%s] %v", name, pattern, err)
+		}
+	}
+	return
+}
+
+// Merge a JSON object from the env var into a map setting, env var values win.
+// A JSON array replaces a list setting.
+func envJSON(name string, value interface{}) {
+	if s := os.Getenv(name); len(s) > 0 {
+		err := json.Unmarshal([]byte(s), value)
+		if err != nil {
+			log.Fatalf("Error: could not parse env var %s: %s, must be a JSON object", name, err)
+		}
+	}
+}
+
+// Apply a default to a setting left empty by both config file and env var
+func defaultString(value *string, def string) {
+	if len(*value) == 0 {
+		*value = def
+	}
+}
+
+// Show only enough of a secret to tell which one is configured
+func maskSecret(secret string) string {
+	if len(secret) <= 4 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
+// Pick the region from the license key when not configured, EU keys start with "eu"
+func regionFromLicenseKey(key string) string {
+	if strings.HasPrefix(strings.ToLower(key), "eu") {
+		return RegionEU
+	}
+	return RegionUS
+}
+
+// Resolve the Metric API URL from an explicit endpoint, or else the region
+func (data *ConfigData) initMetricApi() (err error) {
+	if len(data.Region) == 0 {
+		data.Region = regionFromLicenseKey(data.LicenseKey)
+	}
+	for region := range regionMetricApi {
+		if strings.EqualFold(region, data.Region) {
+			data.Region = region
+		}
+	}
+	api, ok := regionMetricApi[data.Region]
+	if !ok {
+		return fmt.Errorf("invalid region [%s], must be one of US, EU, FedRAMP", data.Region)
 	}
-	data.Service = os.Getenv("NEW_RELIC_APP_NAME")
-	if len(data.Service) == 0 {
-		data.Service = DefaultAppName
+	if len(data.MetricApi) == 0 {
+		data.MetricApi = api
 	}
-	data.Workload = os.Getenv("WORKLOAD_NAME")
-	if len(data.Workload) == 0 {
-		data.Workload = DefaultWorkloadName
+	_, err = url.ParseRequestURI(data.MetricApi)
+	if err != nil {
+		return fmt.Errorf("invalid metric endpoint %v", err)
 	}
-	data.Prefix = os.Getenv("METRIC_PREFIX")
-	if len(data.Prefix) == 0 {
-		data.Prefix = DefaultPrefix
+	return
+}
+
+func (data *ConfigData) initConfig() {
+	var err error
+	var configFile string
+	var logfile *os.File
+
+	// Config file provides base settings, env vars override them
+	configFile, err = data.readConfigFile()
+	if err != nil {
+		log.Fatalf("Error: config file %v", err)
 	}
-	data.Logfile = os.Getenv("NRIA_LOG_FILE")
-	if len(data.Logfile) == 0 {
-		data.Logfile = DefaultLogfile
+
+	// Get license key
+	envString("NEW_RELIC_LICENSE_KEY", &data.LicenseKey)
+	if len(data.LicenseKey) == 0 {
+		log.Fatal("Error: could not locate license_key in config file or env var NEW_RELIC_LICENSE_KEY")
 	}
-	verbose := os.Getenv("NRIA_VERBOSE")
-	DebugLog = len(verbose) > 0 && verbose != "0"
+	envString("NEW_RELIC_APP_NAME", &data.Service)
+	defaultString(&data.Service, DefaultAppName)
+	envString("WORKLOAD_NAME", &data.Workload)
+	defaultString(&data.Workload, DefaultWorkloadName)
+	envString("METRIC_PREFIX", &data.Prefix)
+	defaultString(&data.Prefix, DefaultPrefix)
+	envString("NRIA_LOG_FILE", &data.Logfile)
+	defaultString(&data.Logfile, DefaultLogfile)
+	envBool("NRIA_VERBOSE", &data.Verbose)
+	DebugLog = data.Verbose
+	envString("NEW_RELIC_REGION", &data.Region)
+	envString("NRIA_METRIC_ENDPOINT", &data.MetricApi)
 
 	// Open log file
 	logfile, err = os.OpenFile(data.Logfile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
@@ -87,19 +409,142 @@ func (data *ConfigData) initConfig() {
 	log.SetOutput(logfile)
 
 	// Get poll interval
-	pollInterval := os.Getenv("POLL_INTERVAL")
-	if len(pollInterval) == 0 {
-		pollInterval = DefaultPollInterval
+	envDuration("POLL_INTERVAL", &data.PollInterval)
+	if data.PollInterval <= 0 {
+		data.PollInterval, _ = time.ParseDuration(DefaultPollInterval)
+	}
+
+	// Get spool limits
+	envString("NRIA_SPOOL_DIR", &data.SpoolDir)
+	defaultString(&data.SpoolDir, DefaultSpoolDir)
+	envInt64("NRIA_SPOOL_MAX_BYTES", &data.SpoolMaxBytes)
+	if data.SpoolMaxBytes <= 0 {
+		data.SpoolMaxBytes = DefaultSpoolMaxSize
+	}
+	envDuration("NRIA_SPOOL_MAX_AGE", &data.SpoolMaxAge)
+	if data.SpoolMaxAge <= 0 {
+		data.SpoolMaxAge, _ = time.ParseDuration(DefaultSpoolMaxAge)
+	}
+
+	// Get custom attributes, dropping any that would replace our own
+	envJSON("NRIA_CUSTOM_ATTRIBUTES", &data.CustomAttributes)
+	for k := range data.CustomAttributes {
+		if reservedAttributes[k] || len(k) == 0 {
+			log.Printf("Warning: custom attribute [%s] is reserved, ignoring", k)
+			delete(data.CustomAttributes, k)
+		}
 	}
-	data.PollInterval, err = time.ParseDuration(pollInterval)
+
+	// Get per-core CPU mode
+	envBool("NRIA_PER_CPU", &data.PerCPU)
+
+	// Get container cgroup mode
+	envBool("NRIA_CGROUP_METRICS", &data.CgroupMetrics)
+
+	// Get top-N process mode
+	envBool("NRIA_PROCESS_METRICS", &data.ProcessMetrics)
+	envInt("NRIA_PROCESS_TOP_N", &data.ProcessTopN)
+	if data.ProcessTopN <= 0 {
+		data.ProcessTopN = DefaultProcessTopN
+	}
+
+	// Get process watch list
+	envJSON("NRIA_PROCESS_WATCH", &data.ProcessWatch)
+
+	// Processes are read from /proc, disable rather than fail every poll where there is none
+	if !processMetricsSupported && (data.ProcessMetrics || len(data.ProcessWatch) > 0) {
+		log.Printf("Error: process metrics and process watch are not supported on %s, disabled", runtime.GOOS)
+		data.ProcessMetrics = false
+		data.ProcessWatch = nil
+	}
+
+	// Get network interface filters
+	envList("NRIA_NETWORK_INTERFACE_INCLUDE", &data.NetworkInclude)
+	envList("NRIA_NETWORK_INTERFACE_EXCLUDE", &data.NetworkExclude)
+	envBool("NRIA_NETWORK_SKIP_DOWN", &data.NetworkSkipDown)
+	envBool("NRIA_NETWORK_SKIP_NO_ADDRESS", &data.NetworkSkipNoIP)
+	for name, patterns := range map[string][]string{"network_interface_include": data.NetworkInclude, "network_interface_exclude": data.NetworkExclude} {
+		if err = validatePatterns(name, patterns); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+
+	// Get socket mode and the local ports to count connections on
+	envBool("NRIA_SOCKET_METRICS", &data.SocketMetrics)
+	envIntList("NRIA_SOCKET_PORTS", &data.SocketPorts)
+
+	// Get protocol counter mode and the counters to report
+	envBool("NRIA_PROTOCOL_METRICS", &data.ProtocolMetrics)
+	envList("NRIA_PROTOCOL_COUNTERS", &data.ProtocolCounters)
+	if len(data.ProtocolCounters) == 0 {
+		data.ProtocolCounters = DefaultProtocolCounters
+	}
+
+	// Get storage filesystem types, mount point filters and network filesystem timeout
+	envList("NRIA_STORAGE_FILESYSTEMS", &data.StorageFsTypes)
+	envList("NRIA_STORAGE_MOUNT_INCLUDE", &data.StorageInclude)
+	envList("NRIA_STORAGE_MOUNT_EXCLUDE", &data.StorageExclude)
+	for name, patterns := range map[string][]string{"storage_mount_include": data.StorageInclude, "storage_mount_exclude": data.StorageExclude} {
+		if err = validatePatterns(name, patterns); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	envDuration("NRIA_STORAGE_USAGE_TIMEOUT", &data.StorageTimeout)
+	if data.StorageTimeout <= 0 {
+		data.StorageTimeout, _ = time.ParseDuration(DefaultUsageTimeout)
+	}
+
+	// Get host root, for a containerized agent to monitor the host
+	envString("NRIA_HOST_ROOT", &data.HostRoot)
+	err = data.initHostRoot()
 	if err != nil {
-		log.Fatalf("Error: could not parse env var POLL_INTERVAL: %s, must be a duration (ex: 1h)", err)
+		log.Fatalf("Error: %v", err)
 	}
 
-	// Get hostname
-	data.Hostname, err = os.Hostname()
+	// Get docker mode and the Docker Engine API socket, under the host root when there is one
+	envBool("NRIA_DOCKER_METRICS", &data.DockerMetrics)
+	envString("NRIA_DOCKER_SOCKET", &data.DockerSocket)
+	defaultString(&data.DockerSocket, filepath.Join("/", data.HostRoot, DefaultDockerSocket))
+
+	// Get Kubernetes metadata mode, the downward API volume and the optional kubelet query
+	envBool("NRIA_K8S_METADATA", &data.K8sMetadata)
+	envString("NRIA_K8S_PODINFO_DIR", &data.K8sPodInfoDir)
+	defaultString(&data.K8sPodInfoDir, DefaultPodInfoDir)
+	envList("NRIA_K8S_ANNOTATIONS", &data.K8sAnnotations)
+	envBool("NRIA_K8S_KUBELET", &data.K8sKubelet)
+	envString("NRIA_K8S_KUBELET_URL", &data.K8sKubeletURL)
+	envBool("NRIA_K8S_KUBELET_INSECURE", &data.K8sSkipVerify)
+
+	// Get cloud metadata mode, an optional provider to skip detection, and the metadata service endpoints
+	envBool("NRIA_CLOUD_METADATA", &data.CloudMetadata)
+	envString("NRIA_CLOUD_PROVIDER", &data.CloudProvider)
+	data.CloudProvider = strings.ToLower(data.CloudProvider)
+	if len(data.CloudProvider) > 0 && data.CloudProvider != CloudAWS && data.CloudProvider != CloudGCP && data.CloudProvider != CloudAzure {
+		log.Printf("Error: invalid cloud provider %s, detecting provider", data.CloudProvider)
+		data.CloudProvider = ""
+	}
+	envString("NRIA_CLOUD_AWS_ENDPOINT", &data.CloudAwsURL)
+	defaultString(&data.CloudAwsURL, DefaultAwsMetadataURL)
+	envString("NRIA_CLOUD_GCP_ENDPOINT", &data.CloudGcpURL)
+	defaultString(&data.CloudGcpURL, DefaultGcpMetadataURL)
+	envString("NRIA_CLOUD_AZURE_ENDPOINT", &data.CloudAzureURL)
+	defaultString(&data.CloudAzureURL, DefaultAzureMetadataURL)
+
+	// Get metrics enabled or disabled by name
+	envJSON("NRIA_METRICS", &data.Metrics)
+
+	// Get Metric API endpoint
+	err = data.initMetricApi()
 	if err != nil {
-		log.Fatalf("Error: hostname of server %v", err)
+		log.Fatalf("Error: %v", err)
+	}
+
+	// Get hostname
+	if len(data.Hostname) == 0 {
+		data.Hostname, err = os.Hostname()
+		if err != nil {
+			log.Fatalf("Error: hostname of server %v", err)
+		}
 	}
 
 	// Graceful shutdown
@@ -112,7 +557,56 @@ func (data *ConfigData) initConfig() {
 		os.Exit(0)
 	}()
 
+	if len(configFile) > 0 {
+		log.Printf("Config file: %s", configFile)
+	}
+	data.logConfig()
+}
+
+// Metrics are sent unless disabled in config, or disabled by default and not enabled
+func (data *ConfigData) metricEnabled(name string) bool {
+	if enabled, ok := data.Metrics[name]; ok {
+		return enabled
+	}
+	return !defaultDisabledMetrics[name]
+}
+
+// Log the resolved configuration, with secrets masked
+func (data *ConfigData) logConfig() {
+	log.Printf("License key: %s", maskSecret(data.LicenseKey))
 	log.Printf("Service: %s", data.Service)
 	log.Printf("Workload: %s", data.Workload)
+	log.Printf("Hostname: %s", data.Hostname)
+	log.Printf("Metric prefix: %s", data.Prefix)
+	log.Printf("Log file: %s", data.Logfile)
+	log.Printf("Verbose: %v", data.Verbose)
 	log.Printf("Poll interval: %v", data.PollInterval)
+	log.Printf("Region: %s", data.Region)
+	log.Printf("Metric endpoint: %s", data.MetricApi)
+	log.Printf("Custom attributes: %v", data.CustomAttributes)
+	log.Printf("Metrics: %v", data.Metrics)
+	log.Printf("Per-CPU: %v", data.PerCPU)
+	log.Printf("Cgroup metrics: %v", data.CgroupMetrics)
+	log.Printf("Process metrics: %v, top %d", data.ProcessMetrics, data.ProcessTopN)
+	for _, watch := range data.ProcessWatch {
+		log.Printf("Process watch: %+v", watch)
+	}
+	log.Printf("Network interfaces: include %v, exclude %v, skip down %v, skip no address %v",
+		data.NetworkInclude, data.NetworkExclude, data.NetworkSkipDown, data.NetworkSkipNoIP)
+	log.Printf("Socket metrics: %v, ports %v", data.SocketMetrics, data.SocketPorts)
+	log.Printf("Protocol metrics: %v, counters %v", data.ProtocolMetrics, data.ProtocolCounters)
+	if len(data.StorageFsTypes) > 0 {
+		log.Printf("Storage filesystems: %v", data.StorageFsTypes)
+	}
+	log.Printf("Storage mounts: include %v, exclude %v, usage timeout %v", data.StorageInclude, data.StorageExclude, data.StorageTimeout)
+	if len(data.HostRoot) > 0 {
+		log.Printf("Host root: %s, HOST_PROC %s, HOST_SYS %s, HOST_ETC %s",
+			data.HostRoot, os.Getenv("HOST_PROC"), os.Getenv("HOST_SYS"), os.Getenv("HOST_ETC"))
+	}
+	log.Printf("Docker metrics: %v, socket %s", data.DockerMetrics, data.DockerSocket)
+	log.Printf("Kubernetes metadata: %v, podinfo %s, annotations %v, kubelet %v %s, insecure %v", data.K8sMetadata,
+		data.K8sPodInfoDir, data.K8sAnnotations, data.K8sKubelet, data.K8sKubeletURL, data.K8sSkipVerify)
+	log.Printf("Cloud metadata: %v, provider [%s], aws %s, gcp %s, azure %s", data.CloudMetadata,
+		data.CloudProvider, data.CloudAwsURL, data.CloudGcpURL, data.CloudAzureURL)
+	log.Printf("Spool: %s, max %d bytes, max age %v", data.SpoolDir, data.SpoolMaxBytes, data.SpoolMaxAge)
 }
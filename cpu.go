@@ -10,16 +10,24 @@ import (
 )
 
 type CPUSample struct {
+	CPU              string  `json:"cpu,omitempty"`
 	CPUPercent       float64 `json:"cpuPercent"`
 	CPUUserPercent   float64 `json:"cpuUserPercent"`
 	CPUSystemPercent float64 `json:"cpuSystemPercent"`
 	CPUIOWaitPercent float64 `json:"cpuIOWaitPercent"`
 	CPUIdlePercent   float64 `json:"cpuIdlePercent"`
 	CPUStealPercent  float64 `json:"cpuStealPercent"`
+
+	// Breakdowns of the user and system percentages above
+	CPUNicePercent    float64 `json:"cpuNicePercent"`
+	CPUIrqPercent     float64 `json:"cpuIrqPercent"`
+	CPUSoftirqPercent float64 `json:"cpuSoftirqPercent"`
+	CPUGuestPercent   float64 `json:"cpuGuestPercent"`
 }
 
 type CPUMonitor struct {
 	last     []cpu.TimesStat
+	lastCore map[string]cpu.TimesStat
 	cpuTimes func(bool) ([]cpu.TimesStat, error)
 }
 
@@ -34,7 +42,7 @@ func (self *CPUMonitor) Sample() (sample *CPUSample, err error) {
 		}
 	}()
 
-	if self.last == nil {
+	if len(self.last) <= 0 {
 		self.last, err = self.cpuTimes(false)
 		return &CPUSample{}, nil
 	}
@@ -49,12 +57,50 @@ func (self *CPUMonitor) Sample() (sample *CPUSample, err error) {
 	delta := cpuDelta(&currentTimes[0], &self.last[0])
 	self.last = currentTimes
 
+	sample = cpuPercents(delta)
+	return
+}
+
+// SamplePerCPU returns a sample for each CPU core seen in both this and the previous call.
+// Cores that went offline are dropped, and cores that came online are reported from the next call.
+func (self *CPUMonitor) SamplePerCPU() (samples []*CPUSample, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("Panic in CPUMonitor.SamplePerCPU: %v\nStack: %s", panicErr, debug.Stack())
+		}
+	}()
+
+	currentTimes, err := self.cpuTimes(true)
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]cpu.TimesStat, len(currentTimes))
+	for _, times := range currentTimes {
+		current[times.CPU] = times
+		if last, ok := self.lastCore[times.CPU]; ok {
+			delta := cpuDelta(&times, &last)
+			// skip a core whose counters did not advance, or went backwards
+			if delta.Total() <= 0 {
+				continue
+			}
+			sample := cpuPercents(delta)
+			sample.CPU = times.CPU
+			samples = append(samples, sample)
+		}
+	}
+	self.lastCore = current
+	return
+}
+
+// Determine percentage values by dividing the total CPU time by each portion, then multiply by 100 to get a percentage from 0-100.
+func cpuPercents(delta *cpu.TimesStat) (sample *CPUSample) {
 	userDelta := delta.User + delta.Nice
 	systemDelta := delta.System + delta.Irq + delta.Softirq
 	stolenDelta := delta.Steal
 
-	// Determine percentage values by dividing the total CPU time by each portion, then multiply by 100 to get a percentage from 0-100.
 	var userPercent, stolenPercent, systemPercent, ioWaitPercent float64
+	var nicePercent, irqPercent, softirqPercent, guestPercent float64
 
 	deltaTotal := delta.Total()
 	if deltaTotal != 0 {
@@ -62,6 +108,11 @@ func (self *CPUMonitor) Sample() (sample *CPUSample, err error) {
 		stolenPercent = stolenDelta / deltaTotal * 100.0
 		systemPercent = systemDelta / deltaTotal * 100.0
 		ioWaitPercent = delta.Iowait / deltaTotal * 100.0
+		nicePercent = delta.Nice / deltaTotal * 100.0
+		irqPercent = delta.Irq / deltaTotal * 100.0
+		softirqPercent = delta.Softirq / deltaTotal * 100.0
+		// Guest time is already accounted for in user time
+		guestPercent = (delta.Guest + delta.GuestNice) / deltaTotal * 100.0
 	}
 	idlePercent := 100 - userPercent - systemPercent - ioWaitPercent - stolenPercent
 
@@ -72,6 +123,11 @@ func (self *CPUMonitor) Sample() (sample *CPUSample, err error) {
 		CPUIOWaitPercent: ioWaitPercent,
 		CPUIdlePercent:   idlePercent,
 		CPUStealPercent:  stolenPercent,
+
+		CPUNicePercent:    nicePercent,
+		CPUIrqPercent:     irqPercent,
+		CPUSoftirqPercent: softirqPercent,
+		CPUGuestPercent:   guestPercent,
 	}
 	return
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDockerSocket  = "/var/run/docker.sock"
+	DockerRequestTimeout = 10 * time.Second
+	DockerStatsRequests  = 8
+	dockerIdLength       = 12
+)
+
+// Resource use of one running container. Rates are only set once the container
+// has been seen on a previous poll, HasRates is false for a container that just started.
+type DockerContainerSample struct {
+	ID     string            `json:"containerId"`
+	Name   string            `json:"containerName"`
+	Image  string            `json:"containerImage"`
+	Labels map[string]string `json:"labels"`
+
+	MemoryUsageBytes  float64 `json:"memoryUsageBytes"`
+	MemoryLimitBytes  float64 `json:"memoryLimitBytes"`
+	MemoryUsedPercent float64 `json:"memoryUsedPercent"`
+
+	HasRates               bool    `json:"-"`
+	CPUPercent             float64 `json:"cpuPercent"`
+	NetworkRxBytesPerSec   float64 `json:"networkReceiveBytesPerSec"`
+	NetworkTxBytesPerSec   float64 `json:"networkTransmitBytesPerSec"`
+	NetworkRxErrorsPerSec  float64 `json:"networkReceiveErrorsPerSec"`
+	NetworkTxErrorsPerSec  float64 `json:"networkTransmitErrorsPerSec"`
+	NetworkRxDroppedPerSec float64 `json:"networkReceiveDroppedPerSec"`
+	NetworkTxDroppedPerSec float64 `json:"networkTransmitDroppedPerSec"`
+	DiskReadBytesPerSec    float64 `json:"diskReadBytesPerSec"`
+	DiskWriteBytesPerSec   float64 `json:"diskWriteBytesPerSec"`
+}
+
+// Docker Engine API /containers/json entry
+type dockerContainer struct {
+	Id     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Image  string            `json:"Image"`
+	Labels map[string]string `json:"Labels"`
+}
+
+// Docker Engine API /containers/{id}/stats response, only the fields used
+type dockerStats struct {
+	CPUStats struct {
+		CPUUsage struct {
+			TotalUsage uint64 `json:"total_usage"`
+		} `json:"cpu_usage"`
+	} `json:"cpu_stats"`
+	MemoryStats struct {
+		Usage uint64            `json:"usage"`
+		Limit uint64            `json:"limit"`
+		Stats map[string]uint64 `json:"stats"`
+	} `json:"memory_stats"`
+	Networks map[string]struct {
+		RxBytes   uint64 `json:"rx_bytes"`
+		RxErrors  uint64 `json:"rx_errors"`
+		RxDropped uint64 `json:"rx_dropped"`
+		TxBytes   uint64 `json:"tx_bytes"`
+		TxErrors  uint64 `json:"tx_errors"`
+		TxDropped uint64 `json:"tx_dropped"`
+	} `json:"networks"`
+	BlkioStats struct {
+		IoServiceBytesRecursive []struct {
+			Op    string `json:"op"`
+			Value uint64 `json:"value"`
+		} `json:"io_service_bytes_recursive"`
+	} `json:"blkio_stats"`
+}
+
+// Cumulative counters of a container, summed over its network interfaces and block devices
+type dockerCounters struct {
+	time      time.Time
+	cpu       uint64
+	rxBytes   uint64
+	txBytes   uint64
+	rxErrors  uint64
+	txErrors  uint64
+	rxDropped uint64
+	txDropped uint64
+	read      uint64
+	write     uint64
+}
+
+type DockerMonitor struct {
+	client *http.Client
+	last   map[string]dockerCounters
+}
+
+// NewDockerMonitor returns a monitor that talks to the Docker Engine API on the unix socket
+func NewDockerMonitor(socket string) *DockerMonitor {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &DockerMonitor{
+		client: &http.Client{Transport: transport, Timeout: DockerRequestTimeout},
+		last:   map[string]dockerCounters{},
+	}
+}
+
+func (dm *DockerMonitor) Sample() (samples []*DockerContainerSample, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("Panic in DockerMonitor.Sample: %v\nStack: %s", panicErr, debug.Stack())
+		}
+	}()
+
+	var containers []dockerContainer
+	err = dm.get("/containers/json", &containers)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stats are read in parallel, as older engines take a second or two to answer each,
+	// but only a few at a time so a host with hundreds of containers doesn't swamp the daemon
+	stats := make([]*dockerStats, len(containers))
+	times := make([]time.Time, len(containers))
+	requests := make(chan struct{}, DockerStatsRequests)
+	var wg sync.WaitGroup
+	for i := range containers {
+		wg.Add(1)
+		requests <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-requests }()
+			s := &dockerStats{}
+			// Containers that stopped since the list are skipped
+			if dm.get("/containers/"+containers[i].Id+"/stats?stream=false&one-shot=true", s) == nil {
+				stats[i] = s
+				times[i] = time.Now()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Counters are only kept for running containers, so stopped ones are forgotten
+	current := map[string]dockerCounters{}
+	for i, c := range containers {
+		if stats[i] == nil {
+			continue
+		}
+		counters := dockerCountersFrom(stats[i], times[i])
+		current[c.Id] = counters
+
+		sample := &DockerContainerSample{
+			ID:     shortDockerId(c.Id),
+			Name:   dockerName(c),
+			Image:  c.Image,
+			Labels: c.Labels,
+		}
+		dockerMemory(stats[i], sample)
+		if last, ok := dm.last[c.Id]; ok {
+			dockerRates(counters, last, sample)
+		}
+		samples = append(samples, sample)
+	}
+	dm.last = current
+	return
+}
+
+func (dm *DockerMonitor) get(path string, v interface{}) (err error) {
+	var res *http.Response
+	var b []byte
+
+	res, err = dm.client.Get("http://docker" + path)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	b, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker api %s http status %d", path, res.StatusCode)
+	}
+	return json.Unmarshal(b, v)
+}
+
+func dockerCountersFrom(stats *dockerStats, now time.Time) (counters dockerCounters) {
+	counters.time = now
+	counters.cpu = stats.CPUStats.CPUUsage.TotalUsage
+	for _, n := range stats.Networks {
+		counters.rxBytes += n.RxBytes
+		counters.txBytes += n.TxBytes
+		counters.rxErrors += n.RxErrors
+		counters.txErrors += n.TxErrors
+		counters.rxDropped += n.RxDropped
+		counters.txDropped += n.TxDropped
+	}
+	// Ops are "read" and "write" with cgroup v2, "Read" and "Write" with v1
+	for _, io := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(io.Op) {
+		case "read":
+			counters.read += io.Value
+		case "write":
+			counters.write += io.Value
+		}
+	}
+	return
+}
+
+// Memory usage leaves out the inactive page cache, as docker stats does. Without a limit, the limit is host memory.
+func dockerMemory(stats *dockerStats, sample *DockerContainerSample) {
+	usage := stats.MemoryStats.Usage
+	inactive, ok := stats.MemoryStats.Stats["inactive_file"]
+	if !ok {
+		inactive = stats.MemoryStats.Stats["total_inactive_file"]
+	}
+	if inactive < usage {
+		usage -= inactive
+	}
+	sample.MemoryUsageBytes = float64(usage)
+	sample.MemoryLimitBytes = float64(stats.MemoryStats.Limit)
+	if stats.MemoryStats.Limit > 0 {
+		sample.MemoryUsedPercent = float64(usage) / float64(stats.MemoryStats.Limit) * 100.0
+	}
+}
+
+func dockerRates(current, last dockerCounters, sample *DockerContainerSample) {
+	elapsed := current.time.Sub(last.time).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	rate := func(c, l uint64) float64 {
+		if c < l {
+			return 0
+		}
+		return float64(c-l) / elapsed
+	}
+	sample.HasRates = true
+	// CPU usage is in nanoseconds, 100% is one core
+	sample.CPUPercent = rate(current.cpu, last.cpu) / 1e9 * 100.0
+	sample.NetworkRxBytesPerSec = rate(current.rxBytes, last.rxBytes)
+	sample.NetworkTxBytesPerSec = rate(current.txBytes, last.txBytes)
+	sample.NetworkRxErrorsPerSec = rate(current.rxErrors, last.rxErrors)
+	sample.NetworkTxErrorsPerSec = rate(current.txErrors, last.txErrors)
+	sample.NetworkRxDroppedPerSec = rate(current.rxDropped, last.rxDropped)
+	sample.NetworkTxDroppedPerSec = rate(current.txDropped, last.txDropped)
+	sample.DiskReadBytesPerSec = rate(current.read, last.read)
+	sample.DiskWriteBytesPerSec = rate(current.write, last.write)
+}
+
+func shortDockerId(id string) string {
+	if len(id) > dockerIdLength {
+		return id[:dockerIdLength]
+	}
+	return id
+}
+
+// Names are listed with a leading "/"
+func dockerName(c dockerContainer) string {
+	if len(c.Names) == 0 {
+		return shortDockerId(c.Id)
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// Append the container metrics, with its name, image, ID and labels as attributes
+func (data *ConfigData) appendDockerMetrics(entries []Metric, ds *DockerContainerSample) []Metric {
+	attributes := map[string]string{
+		"containerId":    ds.ID,
+		"containerName":  ds.Name,
+		"containerImage": ds.Image,
+	}
+	for k, v := range ds.Labels {
+		attributes["label."+k] = v
+	}
+
+	entries = data.appendMetricAttributes(entries, "ContainerMemoryUsageBytes", ds.MemoryUsageBytes, attributes)
+	entries = data.appendMetricAttributes(entries, "ContainerMemoryLimitBytes", ds.MemoryLimitBytes, attributes)
+	entries = data.appendMetricAttributes(entries, "ContainerMemoryUsedPercent", ds.MemoryUsedPercent, attributes)
+	if !ds.HasRates {
+		return entries
+	}
+	entries = data.appendMetricAttributes(entries, "ContainerCpuPercent", ds.CPUPercent, attributes)
+	entries = data.appendMetricAttributes(entries, "ContainerNetworkReceiveBytesPerSec", ds.NetworkRxBytesPerSec, attributes)
+	entries = data.appendMetricAttributes(entries, "ContainerNetworkTransmitBytesPerSec", ds.NetworkTxBytesPerSec, attributes)
+	entries = data.appendMetricAttributes(entries, "ContainerNetworkReceiveErrorsPerSec", ds.NetworkRxErrorsPerSec, attributes)
+	entries = data.appendMetricAttributes(entries, "ContainerNetworkTransmitErrorsPerSec", ds.NetworkTxErrorsPerSec, attributes)
+	entries = data.appendMetricAttributes(entries, "ContainerNetworkReceiveDroppedPerSec", ds.NetworkRxDroppedPerSec, attributes)
+	entries = data.appendMetricAttributes(entries, "ContainerNetworkTransmitDroppedPerSec", ds.NetworkTxDroppedPerSec, attributes)
+	entries = data.appendMetricAttributes(entries, "ContainerDiskReadBytesPerSec", ds.DiskReadBytesPerSec, attributes)
+	entries = data.appendMetricAttributes(entries, "ContainerDiskWriteBytesPerSec", ds.DiskWriteBytesPerSec, attributes)
+	return entries
+}
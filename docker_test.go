@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	dockerTestIdA = "aaaaaaaaaaaa1111111111111111111111111111111111111111111111111111"
+	dockerTestIdB = "bbbbbbbbbbbb2222222222222222222222222222222222222222222222222222"
+)
+
+// Cumulative counters the stub reports for a container
+type dockerStubCounters struct {
+	cpu, rx, tx, read, write uint64
+}
+
+// A Docker Engine API stand-in, listing containers and serving their stats
+type dockerStub struct {
+	mu         sync.Mutex
+	containers []dockerContainer
+	counters   map[string]dockerStubCounters
+	stopped    map[string]bool
+
+	// Stats requests being answered, and the most at once
+	inflight, maxInflight int32
+	delay                 time.Duration
+}
+
+func (stub *dockerStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/stats") {
+		n := atomic.AddInt32(&stub.inflight, 1)
+		defer atomic.AddInt32(&stub.inflight, -1)
+		for max := atomic.LoadInt32(&stub.maxInflight); n > max; max = atomic.LoadInt32(&stub.maxInflight) {
+			if atomic.CompareAndSwapInt32(&stub.maxInflight, max, n) {
+				break
+			}
+		}
+		time.Sleep(stub.delay)
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	if r.URL.Path == "/containers/json" {
+		json.NewEncoder(w).Encode(stub.containers)
+		return
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/stats")
+	c, ok := stub.counters[id]
+	if !ok || stub.stopped[id] || r.URL.Query().Get("stream") != "false" {
+		http.Error(w, `{"message":"No such container"}`, http.StatusNotFound)
+		return
+	}
+	// Network and block IO counters are split, to check they are summed
+	fmt.Fprintf(w, `{
+		"cpu_stats": {"cpu_usage": {"total_usage": %d}},
+		"memory_stats": {"usage": 300, "limit": 1000, "stats": {"inactive_file": 100}},
+		"networks": {
+			"eth0": {"rx_bytes": %d, "tx_bytes": %d, "rx_errors": 0, "tx_errors": 0, "rx_dropped": 0, "tx_dropped": 0},
+			"eth1": {"rx_bytes": %d, "tx_bytes": %d, "rx_errors": 0, "tx_errors": 0, "rx_dropped": 0, "tx_dropped": 0}
+		},
+		"blkio_stats": {"io_service_bytes_recursive": [
+			{"major": 8, "minor": 0, "op": "Read", "value": %d},
+			{"major": 8, "minor": 0, "op": "Write", "value": %d},
+			{"major": 8, "minor": 0, "op": "Total", "value": %d}
+		]}
+	}`, c.cpu, c.rx/2, c.tx/2, c.rx-c.rx/2, c.tx-c.tx/2, c.read, c.write, c.read+c.write)
+}
+
+func (stub *dockerStub) set(id string, counters dockerStubCounters) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if _, ok := stub.counters[id]; !ok {
+		stub.containers = append(stub.containers, dockerContainer{
+			Id:     id,
+			Names:  []string{"/" + id[:4]},
+			Image:  "nginx:latest",
+			Labels: map[string]string{"app": "web"},
+		})
+	}
+	stub.counters[id] = counters
+}
+
+func (stub *dockerStub) stop(id string, stopped bool) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	stub.stopped[id] = stopped
+}
+
+// Start the stub on a unix socket, like the Docker daemon
+func newDockerStub(t *testing.T) (*dockerStub, *DockerMonitor) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &dockerStub{counters: map[string]dockerStubCounters{}, stopped: map[string]bool{}}
+	server := httptest.NewUnstartedServer(stub)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return stub, NewDockerMonitor(socket)
+}
+
+// Move the previous poll back in time, so rates are over a known interval
+func (dm *DockerMonitor) shiftLast(d time.Duration) {
+	for id, counters := range dm.last {
+		counters.time = counters.time.Add(-d)
+		dm.last[id] = counters
+	}
+}
+
+func sampleById(samples []*DockerContainerSample) map[string]*DockerContainerSample {
+	byId := map[string]*DockerContainerSample{}
+	for _, s := range samples {
+		byId[s.ID] = s
+	}
+	return byId
+}
+
+func assertNear(t *testing.T, name string, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > want*0.01 {
+		t.Errorf("%s = %v, want %v", name, got, want)
+	}
+}
+
+func TestDockerMonitorRates(t *testing.T) {
+	stub, dm := newDockerStub(t)
+	stub.set(dockerTestIdA, dockerStubCounters{cpu: 1e9, rx: 1000, tx: 2000, read: 4096, write: 8192})
+
+	samples, err := dm.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 {
+		t.Fatalf("got %d samples, want 1", len(samples))
+	}
+	s := samples[0]
+	if s.ID != dockerTestIdA[:dockerIdLength] || s.Name != "aaaa" || s.Image != "nginx:latest" || s.Labels["app"] != "web" {
+		t.Errorf("unexpected container attributes %+v", s)
+	}
+	if s.HasRates {
+		t.Error("rates on the first poll")
+	}
+	// Usage leaves out the inactive page cache
+	if s.MemoryUsageBytes != 200 || s.MemoryLimitBytes != 1000 || s.MemoryUsedPercent != 20 {
+		t.Errorf("memory %v of %v, %v%%", s.MemoryUsageBytes, s.MemoryLimitBytes, s.MemoryUsedPercent)
+	}
+
+	dm.shiftLast(10 * time.Second)
+	stub.set(dockerTestIdA, dockerStubCounters{cpu: 6e9, rx: 11000, tx: 42000, read: 4096 + 40960, write: 8192})
+	samples, err = dm.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = samples[0]
+	if !s.HasRates {
+		t.Fatal("no rates on the second poll")
+	}
+	assertNear(t, "CPUPercent", s.CPUPercent, 50)
+	assertNear(t, "NetworkRxBytesPerSec", s.NetworkRxBytesPerSec, 1000)
+	assertNear(t, "NetworkTxBytesPerSec", s.NetworkTxBytesPerSec, 4000)
+	assertNear(t, "DiskReadBytesPerSec", s.DiskReadBytesPerSec, 4096)
+	if s.DiskWriteBytesPerSec != 0 {
+		t.Errorf("DiskWriteBytesPerSec = %v, want 0", s.DiskWriteBytesPerSec)
+	}
+
+	// A counter reset, as after a container restart, is not a negative rate
+	dm.shiftLast(10 * time.Second)
+	stub.set(dockerTestIdA, dockerStubCounters{cpu: 1e9})
+	samples, err = dm.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if samples[0].CPUPercent != 0 || samples[0].NetworkRxBytesPerSec != 0 {
+		t.Errorf("rates after counter reset %+v", samples[0])
+	}
+}
+
+func TestDockerMonitorContainerStarted(t *testing.T) {
+	stub, dm := newDockerStub(t)
+	stub.set(dockerTestIdA, dockerStubCounters{cpu: 1e9})
+	if _, err := dm.Sample(); err != nil {
+		t.Fatal(err)
+	}
+
+	// B starts after the first poll, so has no rates until the next one
+	stub.set(dockerTestIdB, dockerStubCounters{cpu: 1e9})
+	samples, err := dm.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byId := sampleById(samples)
+	if len(byId) != 2 {
+		t.Fatalf("got %d samples, want 2", len(samples))
+	}
+	if !byId[dockerTestIdA[:dockerIdLength]].HasRates {
+		t.Error("no rates for the running container")
+	}
+	if byId[dockerTestIdB[:dockerIdLength]].HasRates {
+		t.Error("rates for the container that just started")
+	}
+
+	samples, err = dm.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sampleById(samples)[dockerTestIdB[:dockerIdLength]].HasRates {
+		t.Error("no rates for the started container on its second poll")
+	}
+}
+
+func TestDockerMonitorContainerStopped(t *testing.T) {
+	stub, dm := newDockerStub(t)
+	stub.set(dockerTestIdA, dockerStubCounters{cpu: 1e9})
+	stub.set(dockerTestIdB, dockerStubCounters{cpu: 1e9})
+	if _, err := dm.Sample(); err != nil {
+		t.Fatal(err)
+	}
+
+	// B is still listed, but stopped before its stats were read
+	stub.stop(dockerTestIdB, true)
+	samples, err := dm.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0].ID != dockerTestIdA[:dockerIdLength] {
+		t.Fatalf("got samples %+v, want only the running container", samples)
+	}
+	if _, ok := dm.last[dockerTestIdB]; ok {
+		t.Error("counters kept for the stopped container")
+	}
+
+	// Started again, it is a new container without rates
+	stub.stop(dockerTestIdB, false)
+	samples, err = dm.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sampleById(samples)[dockerTestIdB[:dockerIdLength]].HasRates {
+		t.Error("rates for the container that started again")
+	}
+}
+
+// Stats are read in parallel, but no more than DockerStatsRequests at a time
+func TestDockerMonitorStatsRequests(t *testing.T) {
+	stub, dm := newDockerStub(t)
+	stub.delay = 20 * time.Millisecond
+	for i := 0; i < 4*DockerStatsRequests; i++ {
+		stub.set(fmt.Sprintf("%064x", i+1), dockerStubCounters{cpu: 1e9})
+	}
+
+	samples, err := dm.Sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 4*DockerStatsRequests {
+		t.Fatalf("got %d samples, want %d", len(samples), 4*DockerStatsRequests)
+	}
+	if max := atomic.LoadInt32(&stub.maxInflight); max > DockerStatsRequests || max < 2 {
+		t.Errorf("%d stats requests at once, want 2 to %d", max, DockerStatsRequests)
+	}
+}
+
+func TestDockerMonitorUnreachable(t *testing.T) {
+	dm := NewDockerMonitor(filepath.Join(t.TempDir(), "missing.sock"))
+	if _, err := dm.Sample(); err == nil {
+		t.Error("no error without a Docker daemon")
+	}
+}
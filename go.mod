@@ -5,4 +5,5 @@ go 1.15
 require (
 	github.com/newrelic/infrastructure-agent v0.0.0-20220211150853-ef80cad7373f
 	github.com/shirou/gopsutil v3.21.11+incompatible
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPodInfoDir         = "/etc/podinfo"
+	ServiceAccountDir         = "/var/run/secrets/kubernetes.io/serviceaccount"
+	KubeletPort               = "10250"
+	KubernetesRefreshInterval = 5 * time.Minute
+	KubeletRequestTimeout     = 5 * time.Second
+)
+
+// Downward API env vars, the first one set is used
+var (
+	podNameEnv       = []string{"POD_NAME", "K8S_POD_NAME", "MY_POD_NAME"}
+	podNamespaceEnv  = []string{"POD_NAMESPACE", "K8S_NAMESPACE", "MY_POD_NAMESPACE"}
+	nodeNameEnv      = []string{"NODE_NAME", "K8S_NODE_NAME", "MY_NODE_NAME"}
+	containerNameEnv = []string{"CONTAINER_NAME", "K8S_CONTAINER_NAME"}
+)
+
+// KubernetesMetadata adds the pod's name, namespace, node, container and labels to the common attributes.
+// They come from downward API env vars and files, and optionally the kubelet, refreshed every few minutes
+// as labels can change while the pod runs.
+type KubernetesMetadata struct {
+	podInfoDir        string
+	serviceAccountDir string
+	annotations       []string
+	kubeletURL        string
+	client            *http.Client
+	attributes        map[string]string
+	lastRefresh       time.Time
+}
+
+// Kubelet /pods response, only the fields used
+type kubeletPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name        string            `json:"name"`
+			Namespace   string            `json:"namespace"`
+			Labels      map[string]string `json:"labels"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			NodeName string `json:"nodeName"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// NewKubernetesMetadata returns the metadata even on error, which only disables the kubelet query
+func NewKubernetesMetadata(data *ConfigData) (km *KubernetesMetadata, err error) {
+	km = &KubernetesMetadata{
+		podInfoDir:        data.K8sPodInfoDir,
+		serviceAccountDir: ServiceAccountDir,
+		annotations:       data.K8sAnnotations,
+	}
+	if !data.K8sKubelet {
+		return
+	}
+
+	km.kubeletURL = data.K8sKubeletURL
+	if len(km.kubeletURL) == 0 {
+		node := firstEnv(nodeNameEnv)
+		if len(node) == 0 {
+			return km, fmt.Errorf("kubelet url not set, and no node name in %v", nodeNameEnv)
+		}
+		km.kubeletURL = "https://" + net.JoinHostPort(node, KubeletPort) + "/pods"
+	}
+
+	// Kubelet serving certificates are often self-signed, rather than signed by the cluster CA
+	tlsConfig := &tls.Config{InsecureSkipVerify: data.K8sSkipVerify}
+	if !data.K8sSkipVerify {
+		var ca []byte
+		ca, err = ioutil.ReadFile(filepath.Join(km.serviceAccountDir, "ca.crt"))
+		if err != nil {
+			return km, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+	}
+	km.client = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   KubeletRequestTimeout,
+	}
+	return
+}
+
+// Attributes are refreshed when stale, keeping the last kubelet values if it can't be reached
+func (km *KubernetesMetadata) Attributes() map[string]string {
+	if km.attributes != nil && time.Since(km.lastRefresh) < KubernetesRefreshInterval {
+		return km.attributes
+	}
+	km.lastRefresh = time.Now()
+
+	attributes := map[string]string{}
+	setAttribute(attributes, "k8s.podName", firstEnv(podNameEnv))
+	setAttribute(attributes, "k8s.namespace", firstEnv(podNamespaceEnv))
+	setAttribute(attributes, "k8s.nodeName", firstEnv(nodeNameEnv))
+	setAttribute(attributes, "k8s.containerName", firstEnv(containerNameEnv))
+
+	// The pod name is the hostname, and the namespace is mounted with the service account
+	if len(attributes["k8s.podName"]) == 0 {
+		hostname, _ := os.Hostname()
+		setAttribute(attributes, "k8s.podName", hostname)
+	}
+	if len(attributes["k8s.namespace"]) == 0 {
+		b, _ := ioutil.ReadFile(filepath.Join(km.serviceAccountDir, "namespace"))
+		setAttribute(attributes, "k8s.namespace", strings.TrimSpace(string(b)))
+	}
+
+	labels, _ := readPodInfo(filepath.Join(km.podInfoDir, "labels"))
+	annotations, _ := readPodInfo(filepath.Join(km.podInfoDir, "annotations"))
+
+	if km.client != nil {
+		err := km.queryKubelet(attributes, labels, annotations)
+		if err != nil {
+			log.Printf("Error: kubelet %v", err)
+			if km.attributes != nil {
+				return km.attributes
+			}
+		}
+	}
+
+	for k, v := range labels {
+		attributes["k8s.label."+k] = v
+	}
+	// Annotations can be large, only the ones asked for are sent
+	for _, k := range km.annotations {
+		setAttribute(attributes, "k8s.annotation."+k, annotations[k])
+	}
+	km.attributes = attributes
+	return attributes
+}
+
+// Find this pod in the kubelet's pod list, and merge in its node name, labels and annotations
+func (km *KubernetesMetadata) queryKubelet(attributes, labels, annotations map[string]string) (err error) {
+	var req *http.Request
+	var res *http.Response
+	var token, b []byte
+
+	token, err = ioutil.ReadFile(filepath.Join(km.serviceAccountDir, "token"))
+	if err != nil {
+		return
+	}
+	req, err = http.NewRequest(http.MethodGet, km.kubeletURL, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	res, err = km.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	b, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s http status %d", km.kubeletURL, res.StatusCode)
+	}
+	pods := kubeletPodList{}
+	err = json.Unmarshal(b, &pods)
+	if err != nil {
+		return
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Metadata.Name != attributes["k8s.podName"] || pod.Metadata.Namespace != attributes["k8s.namespace"] {
+			continue
+		}
+		setAttribute(attributes, "k8s.nodeName", pod.Spec.NodeName)
+		for k, v := range pod.Metadata.Labels {
+			labels[k] = v
+		}
+		for k, v := range pod.Metadata.Annotations {
+			annotations[k] = v
+		}
+		return
+	}
+	return fmt.Errorf("pod %s/%s not found", attributes["k8s.namespace"], attributes["k8s.podName"])
+}
+
+// Downward API files have a line per key, with a quoted value: app="web"
+func readPodInfo(filename string) (values map[string]string, err error) {
+	var f *os.File
+
+	values = map[string]string{}
+	f, err = os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value, err := strconv.Unquote(kv[1])
+		if err != nil {
+			value = kv[1]
+		}
+		values[kv[0]] = value
+	}
+	err = scanner.Err()
+	return
+}
+
+func firstEnv(names []string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}
+
+// Empty values are left out, rather than sent as empty attributes
+func setAttribute(attributes map[string]string, name, value string) {
+	if len(value) > 0 {
+		attributes[name] = value
+	}
+}
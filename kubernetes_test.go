@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const kubeletTestToken = "eyJhbGciOiJSUzI1NiJ9.test"
+
+// A kubelet stand-in, serving /pods to requests with the service account token
+type kubeletStub struct {
+	mu       sync.Mutex
+	labels   map[string]string
+	fail     bool
+	requests int
+}
+
+func (stub *kubeletStub) setLabels(labels map[string]string, fail bool) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	stub.labels = labels
+	stub.fail = fail
+}
+
+func (stub *kubeletStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+
+	stub.requests++
+	if r.Header.Get("Authorization") != "Bearer "+kubeletTestToken {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if stub.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path != "/pods" {
+		http.NotFound(w, r)
+		return
+	}
+	// A pod with the same name in another namespace, to check both are matched
+	pod := func(name, namespace, node string, labels, annotations map[string]string) map[string]interface{} {
+		return map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"name": name, "namespace": namespace, "labels": labels, "annotations": annotations,
+			},
+			"spec": map[string]string{"nodeName": node},
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"items": []interface{}{
+			pod("web-7d4b9", "staging", "node-2", map[string]string{"app": "staging"}, nil),
+			pod("web-7d4b9", "default", "node-1", stub.labels, map[string]string{
+				"team":                   "payments",
+				"kubectl.kubernetes.io/": "{large}",
+			}),
+		},
+	})
+}
+
+// Clear the downward API env vars, so the ones set by a test are the only ones
+func clearPodEnv(t *testing.T) {
+	for _, names := range [][]string{podNameEnv, podNamespaceEnv, nodeNameEnv, containerNameEnv} {
+		for _, name := range names {
+			t.Setenv(name, "")
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, dir, name, content string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Downward API files in podinfo, and the service account token and namespace
+func k8sTestConfig(t *testing.T) (*ConfigData, string) {
+	podInfoDir := t.TempDir()
+	writeTestFile(t, podInfoDir, "labels", "app=\"web\"\npod-template-hash=\"7d4b9\"\n")
+	writeTestFile(t, podInfoDir, "annotations", "team=\"checkout\"\nnote=\"say \\\"hi\\\"\"\nkubectl.kubernetes.io/=\"{large}\"\n")
+
+	serviceAccountDir := t.TempDir()
+	writeTestFile(t, serviceAccountDir, "token", kubeletTestToken+"\n")
+	writeTestFile(t, serviceAccountDir, "namespace", "default")
+
+	return &ConfigData{K8sPodInfoDir: podInfoDir, K8sAnnotations: []string{"team", "note", "missing"}}, serviceAccountDir
+}
+
+func newTestKubernetesMetadata(t *testing.T, data *ConfigData, serviceAccountDir string) *KubernetesMetadata {
+	km, err := NewKubernetesMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	km.serviceAccountDir = serviceAccountDir
+	return km
+}
+
+func TestKubernetesMetadataPodInfo(t *testing.T) {
+	clearPodEnv(t)
+	t.Setenv("POD_NAME", "web-7d4b9")
+	t.Setenv("POD_NAMESPACE", "shop")
+	t.Setenv("NODE_NAME", "node-1")
+	t.Setenv("CONTAINER_NAME", "nginx")
+	data, serviceAccountDir := k8sTestConfig(t)
+
+	km := newTestKubernetesMetadata(t, data, serviceAccountDir)
+	want := map[string]string{
+		"k8s.podName":                 "web-7d4b9",
+		"k8s.namespace":               "shop",
+		"k8s.nodeName":                "node-1",
+		"k8s.containerName":           "nginx",
+		"k8s.label.app":               "web",
+		"k8s.label.pod-template-hash": "7d4b9",
+		"k8s.annotation.team":         "checkout",
+		"k8s.annotation.note":         `say "hi"`,
+	}
+	if got := km.Attributes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("attributes %v, want %v", got, want)
+	}
+}
+
+func TestKubernetesMetadataEnvFallback(t *testing.T) {
+	clearPodEnv(t)
+	data, serviceAccountDir := k8sTestConfig(t)
+	data.K8sPodInfoDir = filepath.Join(t.TempDir(), "missing")
+
+	// Alternate env var names are used when the first isn't set
+	t.Setenv("K8S_POD_NAME", "web-7d4b9")
+	t.Setenv("MY_POD_NAMESPACE", "shop")
+	t.Setenv("MY_NODE_NAME", "node-1")
+	km := newTestKubernetesMetadata(t, data, serviceAccountDir)
+	want := map[string]string{
+		"k8s.podName":   "web-7d4b9",
+		"k8s.namespace": "shop",
+		"k8s.nodeName":  "node-1",
+	}
+	if got := km.Attributes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("attributes %v, want %v", got, want)
+	}
+
+	// Without any, the pod name is the hostname and the namespace is the service account's
+	clearPodEnv(t)
+	hostname, _ := os.Hostname()
+	km = newTestKubernetesMetadata(t, data, serviceAccountDir)
+	want = map[string]string{
+		"k8s.podName":   hostname,
+		"k8s.namespace": "default",
+	}
+	if got := km.Attributes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("attributes %v, want %v", got, want)
+	}
+}
+
+func TestKubernetesMetadataKubelet(t *testing.T) {
+	clearPodEnv(t)
+	t.Setenv("POD_NAME", "web-7d4b9")
+	data, serviceAccountDir := k8sTestConfig(t)
+	stub := &kubeletStub{labels: map[string]string{"app": "web", "version": "v2"}}
+	server := httptest.NewTLSServer(stub)
+	t.Cleanup(server.Close)
+	data.K8sKubelet = true
+	data.K8sKubeletURL = server.URL + "/pods"
+	data.K8sSkipVerify = true
+
+	km := newTestKubernetesMetadata(t, data, serviceAccountDir)
+	want := map[string]string{
+		"k8s.podName":                 "web-7d4b9",
+		"k8s.namespace":               "default",
+		"k8s.nodeName":                "node-1",
+		"k8s.label.app":               "web",
+		"k8s.label.version":           "v2",
+		"k8s.label.pod-template-hash": "7d4b9",
+		"k8s.annotation.team":         "payments",
+		"k8s.annotation.note":         `say "hi"`,
+	}
+	if got := km.Attributes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("attributes %v, want %v", got, want)
+	}
+
+	// Cached until the refresh interval passes, as labels can change while the pod runs
+	stub.setLabels(map[string]string{"app": "web", "version": "v3"}, false)
+	km.Attributes()
+	if stub.requests != 1 {
+		t.Errorf("%d kubelet requests before refresh, want 1", stub.requests)
+	}
+	km.lastRefresh = time.Now().Add(-KubernetesRefreshInterval)
+	if got := km.Attributes()["k8s.label.version"]; got != "v3" {
+		t.Errorf("version label %s after refresh, want v3", got)
+	}
+
+	// Without the service account token, the kubelet turns the request down
+	writeTestFile(t, serviceAccountDir, "token", "expired")
+	km.lastRefresh = time.Now().Add(-KubernetesRefreshInterval)
+	if got := km.Attributes()["k8s.label.version"]; got != "v3" {
+		t.Errorf("version label %s when unauthorized, want the cached v3", got)
+	}
+}
+
+func TestKubernetesMetadataKubeletURL(t *testing.T) {
+	clearPodEnv(t)
+	data := &ConfigData{K8sKubelet: true, K8sSkipVerify: true}
+	if _, err := NewKubernetesMetadata(data); err == nil {
+		t.Error("no error without a kubelet url or node name")
+	}
+
+	t.Setenv("NODE_NAME", "node-1")
+	km, err := NewKubernetesMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if km.kubeletURL != "https://node-1:10250/pods" {
+		t.Errorf("kubelet url %s, want the node's", km.kubeletURL)
+	}
+}
+
+func TestKubernetesMetadataKubeletUnreachable(t *testing.T) {
+	clearPodEnv(t)
+	t.Setenv("POD_NAME", "web-7d4b9")
+	data, serviceAccountDir := k8sTestConfig(t)
+	data.K8sKubelet = true
+	data.K8sKubeletURL = unreachableURL(t) + "/pods"
+	data.K8sSkipVerify = true
+
+	// The downward API attributes are still sent, without a kubelet
+	km := newTestKubernetesMetadata(t, data, serviceAccountDir)
+	want := map[string]string{
+		"k8s.podName":                 "web-7d4b9",
+		"k8s.namespace":               "default",
+		"k8s.label.app":               "web",
+		"k8s.label.pod-template-hash": "7d4b9",
+		"k8s.annotation.team":         "checkout",
+		"k8s.annotation.note":         `say "hi"`,
+	}
+	if got := km.Attributes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("attributes %v, want %v", got, want)
+	}
+
+	// Once the kubelet has answered, its values are kept while it's unreachable
+	stub := &kubeletStub{labels: map[string]string{"version": "v2"}}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	km.kubeletURL = server.URL + "/pods"
+	km.lastRefresh = time.Now().Add(-KubernetesRefreshInterval)
+	if got := km.Attributes()["k8s.label.version"]; got != "v2" {
+		t.Fatalf("version label %s from the kubelet, want v2", got)
+	}
+
+	stub.setLabels(nil, true)
+	km.lastRefresh = time.Now().Add(-KubernetesRefreshInterval)
+	got := km.Attributes()
+	if got["k8s.label.version"] != "v2" || got["k8s.nodeName"] != "node-1" {
+		t.Errorf("attributes %v after failed refresh, want the cached ones", got)
+	}
+	if time.Since(km.lastRefresh) > time.Minute {
+		t.Error("failed refresh is retried every poll")
+	}
+
+	// A pod the kubelet doesn't know keeps the cached values too
+	t.Setenv("POD_NAME", "web-gone")
+	stub.setLabels(map[string]string{"version": "v3"}, false)
+	km.lastRefresh = time.Now().Add(-KubernetesRefreshInterval)
+	if got := km.Attributes()["k8s.podName"]; got != "web-7d4b9" {
+		t.Errorf("podName %s for an unknown pod, want the cached web-7d4b9", got)
+	}
+}
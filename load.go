@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/shirou/gopsutil/cpu"
+)
+
+type LoadSample struct {
+	Load1        float64 `json:"load1"`
+	Load5        float64 `json:"load5"`
+	Load15       float64 `json:"load15"`
+	Load1PerCPU  float64 `json:"load1PerCpu"`
+	Load5PerCPU  float64 `json:"load5PerCpu"`
+	Load15PerCPU float64 `json:"load15PerCpu"`
+	ProcsRunning float64 `json:"procsRunning"`
+	ProcsBlocked float64 `json:"procsBlocked"`
+}
+
+type LoadMonitor struct {
+	loadHarvest func() (*LoadSample, error)
+	cpuCount    func(bool) (int, error)
+}
+
+func (lm *LoadMonitor) Sample() (sample *LoadSample, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("Panic in LoadMonitor.Sample: %v\nStack: %s", panicErr, debug.Stack())
+		}
+	}()
+
+	sample, err = lm.loadHarvest()
+	if err != nil {
+		return nil, err
+	}
+
+	// Normalize by logical CPUs, so 1.0 means every core is busy
+	cpus, err := lm.cpuCount(true)
+	if err != nil {
+		return nil, err
+	}
+	if cpus > 0 {
+		sample.Load1PerCPU = sample.Load1 / float64(cpus)
+		sample.Load5PerCPU = sample.Load5 / float64(cpus)
+		sample.Load15PerCPU = sample.Load15 / float64(cpus)
+	}
+	return
+}
+
+func NewLoadMonitor() *LoadMonitor {
+	return &LoadMonitor{loadHarvest: loadSample, cpuCount: cpu.Counts}
+}
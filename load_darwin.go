@@ -0,0 +1,22 @@
+package main
+
+import "github.com/shirou/gopsutil/load"
+
+// returns the load average and process counts as reported by the Gopsutil library
+func loadSample() (*LoadSample, error) {
+	avg, err := load.Avg()
+	if err != nil {
+		return nil, err
+	}
+	misc, err := load.Misc()
+	if err != nil {
+		return nil, err
+	}
+	return &LoadSample{
+		Load1:        avg.Load1,
+		Load5:        avg.Load5,
+		Load15:       avg.Load15,
+		ProcsRunning: float64(misc.ProcsRunning),
+		ProcsBlocked: float64(misc.ProcsBlocked),
+	}, nil
+}
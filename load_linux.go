@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/newrelic/infrastructure-agent/pkg/helpers"
+)
+
+// Reads load averages from /proc/loadavg and run-queue counts from /proc/stat
+func loadSample() (*LoadSample, error) {
+	sample, err := parseLoadAvg(helpers.HostProc("loadavg"))
+	if err != nil {
+		return nil, err
+	}
+	err = parseProcsStat(helpers.HostProc("stat"), sample)
+	if err != nil {
+		return nil, err
+	}
+	return sample, nil
+}
+
+// /proc/loadavg looks like "0.20 0.18 0.12 1/80 11206"
+func parseLoadAvg(filename string) (sample *LoadSample, err error) {
+	var b []byte
+	var loads [3]float64
+
+	b, err = ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("unexpected format in %s", filename)
+	}
+	for i := range loads {
+		loads[i], err = strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return
+		}
+	}
+	sample = &LoadSample{Load1: loads[0], Load5: loads[1], Load15: loads[2]}
+	return
+}
+
+// Reads the procs_running and procs_blocked lines of /proc/stat
+func parseProcsStat(filename string, sample *LoadSample) (err error) {
+	var f *os.File
+
+	f, err = os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "procs_running":
+			sample.ProcsRunning, err = strconv.ParseFloat(fields[1], 64)
+		case "procs_blocked":
+			sample.ProcsBlocked, err = strconv.ParseFloat(fields[1], 64)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return scanner.Err()
+}
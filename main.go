@@ -4,11 +4,10 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
-	"io"
-	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/newrelic/infrastructure-agent/pkg/sample"
@@ -16,67 +15,76 @@ import (
 
 type Metric map[string]interface{}
 
-// To send JSON to NR Logs API
+// To send JSON to NR Metric API
 type Payload struct {
+	Common  *Common  `json:"common,omitempty"`
 	Metrics []Metric `json:"metrics"`
 }
 
-// Make API request with error retry
-func retryQuery(client *http.Client, method, url string, data []byte, headers []string) (b []byte) {
-	var res *http.Response
-	var err error
-	var body io.Reader
+// Values shared by every metric in a payload
+type Common struct {
+	Timestamp  int64             `json:"timestamp"`
+	IntervalMs int64             `json:"interval.ms"`
+	Attributes map[string]string `json:"attributes"`
+}
 
-	if len(data) > 0 {
-		body = bytes.NewReader(data)
-	}
+// An AttributeEnricher adds attributes about where infra-lite runs to the common block
+type AttributeEnricher interface {
+	Attributes() map[string]string
+}
 
-	req, _ := http.NewRequest(method, url, body)
-	for _, h := range headers {
-		params := strings.Split(h, ":")
-		req.Header.Set(params[0], params[1])
+func (data *ConfigData) makeCommon() (common *Common) {
+	// Create metric API common block, custom attributes win over enrichment
+	attributes := map[string]string{
+		"workload": data.Workload,
+		"service":  data.Service,
+		"hostname": data.Hostname,
 	}
-
-	// up to 3 retries on API error
-	for j := 1; j <= 3; j++ {
-		res, err = client.Do(req)
-		if err != nil {
-			log.Println(err)
-		} else if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusAccepted {
-			break
-		} else {
-			log.Printf("Retry %d: http status %d", j, res.StatusCode)
+	for _, enricher := range data.enrichers {
+		for k, v := range enricher.Attributes() {
+			attributes[k] = v
 		}
 	}
-	if err == nil {
-		b, err = ioutil.ReadAll(res.Body)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		res.Body.Close()
+	for k, v := range data.CustomAttributes {
+		attributes[k] = v
+	}
+	common = &Common{
+		Timestamp:  data.SampleTime,
+		IntervalMs: data.PollInterval.Milliseconds(),
+		Attributes: attributes,
 	}
 	return
 }
 
 func (data *ConfigData) makeMetric(name string, value float64) (metric Metric) {
-	// Create metric API entry
-	attributes := map[string]string{
-		"workload": data.Workload,
-		"service":  data.Service,
-		"hostname": data.Hostname,
-	}
+	// Create metric API entry, attributes are only the dimensions of this metric
 	metric = Metric{
 		"name":       data.Prefix + "." + name,
 		"type":       "gauge",
 		"value":      value,
-		"timestamp":  data.SampleTime,
-		"attributes": attributes,
+		"attributes": map[string]string{},
 	}
 	return
 }
 
-func compressPayload(payload Payload) (b []byte) {
+// Append a metric entry, unless it is disabled in config
+func (data *ConfigData) appendMetric(entries []Metric, name string, value float64) []Metric {
+	return data.appendMetricAttributes(entries, name, value, nil)
+}
+
+// Append a metric entry with its dimensions, unless it is disabled in config
+func (data *ConfigData) appendMetricAttributes(entries []Metric, name string, value float64, attributes map[string]string) []Metric {
+	if !data.metricEnabled(name) {
+		return entries
+	}
+	metric := data.makeMetric(name, value)
+	for k, v := range attributes {
+		metric["attributes"].(map[string]string)[k] = v
+	}
+	return append(entries, metric)
+}
+
+func compressPayload(payload Payload) (b []byte, size int) {
 	// Marshall and compress JSON
 	j, err2 := json.Marshal([]Payload{payload})
 	if err2 != nil {
@@ -96,32 +104,155 @@ func compressPayload(payload Payload) (b []byte) {
 
 	//log.Printf("Metric payload to post: length %d compressed %d", len(j), gzBuf.Len())
 	b = gzBuf.Bytes()
+	size = len(j)
 	return
 }
 
 func main() {
 	var err error
 	var cpuSample *CPUSample
+	var cpuCoreSamples []*CPUSample
+	var cgroupCPUSample *CgroupCPUSample
+	var cgroupCPUMonitor *CgroupCPUMonitor
+	var cgroupMemSample *CgroupMemorySample
+	var cgroupMemoryMonitor *CgroupMemoryMonitor
+	var cgroup *Cgroup
+	var pressureSamples []*PressureSample
+	var processSamples []*ProcessSample
+	var processMonitor *ProcessMonitor
+	var watchSamples []*ProcessWatchSample
+	var processWatcher *ProcessWatcher
+	var socketSample *SocketSample
+	var socketMonitor *SocketMonitor
+	var protocolSamples []*ProtocolSample
+	var protocolMonitor *ProtocolMonitor
+	var dockerSamples []*DockerContainerSample
+	var dockerMonitor *DockerMonitor
 	var memSample *MemorySample
-	var netSample, storageSample sample.EventBatch
+	var loadAvg *LoadSample
+	var netSample []*NetworkSample
+	var storageSample sample.EventBatch
 
-	// Get configuration from env vars and/or newrelic.yml
+	// Get configuration from infra-lite.yml and/or env vars
 	data := ConfigData{}
 	data.initConfig()
 
+	// Initialize attribute enrichment
+	if data.K8sMetadata {
+		k8s, err := NewKubernetesMetadata(&data)
+		if err != nil {
+			log.Printf("Error: kubelet query disabled %v", err)
+		}
+		data.enrichers = append(data.enrichers, k8s)
+		log.Printf("Kubernetes attributes: %v", k8s.Attributes())
+	}
+	if data.CloudMetadata {
+		cloud, err := NewCloudMetadata(&data)
+		if err != nil {
+			log.Printf("Error: cloud metadata disabled %v", err)
+		} else {
+			data.enrichers = append(data.enrichers, cloud)
+			log.Printf("Cloud attributes: %v", cloud.Attributes())
+		}
+	}
+
 	// Initialize monitors
 	cpuMonitor := NewCPUMonitor()
 	memoryMonitor := NewMemoryMonitor()
-	networkMonitor := NewNetworkMonitor()
-	storageMonitor := NewSampler(data.PollInterval)
+	loadMonitor := NewLoadMonitor()
+	if data.CgroupMetrics {
+		cgroup, err = DetectCgroup()
+		if err != nil {
+			log.Printf("Error: cgroup metrics disabled %v", err)
+		} else {
+			log.Printf("Cgroup v%d detected", cgroup.Version)
+			cgroupCPUMonitor, err = NewCgroupCPUMonitor(cgroup)
+			if err != nil {
+				log.Printf("Cgroup CPU metrics disabled, %v", err)
+			}
+
+			// Report memory against the container limit, when it has one
+			cgroupMemoryMonitor, err = NewCgroupMemoryMonitor(cgroup, memoryMonitor.vmHarvest)
+			if err != nil {
+				log.Printf("Cgroup memory metrics disabled, %v", err)
+			} else {
+				memoryMonitor.vmHarvest = cgroupMemoryMonitor.VirtualMemory
+			}
+		}
+	}
+	pressureMonitor, err := NewPressureMonitor(cgroup)
+	if err != nil {
+		log.Printf("Pressure metrics disabled, %v", err)
+	}
+	if data.ProcessMetrics {
+		processMonitor = NewProcessMonitor(data.ProcessTopN)
+	}
+	if len(data.ProcessWatch) > 0 {
+		processWatcher, err = NewProcessWatcher(data.ProcessWatch, data.HostRoot)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	if data.SocketMetrics {
+		socketMonitor = NewSocketMonitor(data.SocketPorts, data.HostRoot)
+	}
+	if data.ProtocolMetrics {
+		protocolMonitor = NewProtocolMonitor(data.ProtocolCounters, data.HostRoot)
+	}
+	if data.DockerMetrics {
+		dockerMonitor = NewDockerMonitor(data.DockerSocket)
+	}
+	networkMonitor := NewNetworkMonitor(InterfaceFilter{
+		Include:       data.NetworkInclude,
+		Exclude:       data.NetworkExclude,
+		SkipDown:      data.NetworkSkipDown,
+		SkipNoAddress: data.NetworkSkipNoIP,
+	})
+	if len(data.StorageFsTypes) > 0 {
+		setSupportedFileSystems(data.StorageFsTypes)
+	}
+	storageMonitor := NewSampler(data.PollInterval, MountFilter{
+		Include:      data.StorageInclude,
+		Exclude:      data.StorageExclude,
+		UsageTimeout: data.StorageTimeout,
+	}, data.HostRoot)
 
 	// Prime CPU and Disk monitor with first calls
 	_, err = cpuMonitor.Sample()
+	if data.PerCPU {
+		_, err = cpuMonitor.SamplePerCPU()
+	}
+	if cgroupCPUMonitor != nil {
+		_, err = cgroupCPUMonitor.Sample()
+	}
+	if pressureMonitor != nil {
+		_, err = pressureMonitor.Sample()
+	}
+	if processMonitor != nil {
+		_, err = processMonitor.Sample()
+	}
+	if processWatcher != nil {
+		_, err = processWatcher.Sample()
+	}
+	if protocolMonitor != nil {
+		_, err = protocolMonitor.Sample()
+	}
+	if dockerMonitor != nil {
+		_, err = dockerMonitor.Sample()
+	}
 	time.Sleep(time.Second)
 
 	// Configure NR metrics API client
+	rand.Seed(time.Now().UnixNano())
 	client := &http.Client{}
 	headers := []string{"Content-Type:application/json", "Content-Encoding:gzip", "Api-Key:" + data.LicenseKey}
+	sender := NewSender(client, data.MetricApi, headers)
+
+	// Keep undelivered payloads on disk
+	spool, err := NewSpool(data.SpoolDir, data.SpoolMaxBytes, data.SpoolMaxAge)
+	if err != nil {
+		log.Printf("Error: spool disabled %v", err)
+	}
 
 	// Start poll loop
 	for {
@@ -134,23 +265,144 @@ func main() {
 		if err != nil {
 			log.Printf("Error: cpuMonitor %v", err)
 		} else {
-			entries = append(entries, data.makeMetric("CpuPercent", cpuSample.CPUPercent))
-			entries = append(entries, data.makeMetric("CpuUserPercent", cpuSample.CPUUserPercent))
-			entries = append(entries, data.makeMetric("CpuSystemPercent", cpuSample.CPUSystemPercent))
+			entries = data.appendMetric(entries, "CpuPercent", cpuSample.CPUPercent)
+			entries = data.appendMetric(entries, "CpuUserPercent", cpuSample.CPUUserPercent)
+			entries = data.appendMetric(entries, "CpuSystemPercent", cpuSample.CPUSystemPercent)
+			entries = data.appendMetric(entries, "CpuIOWaitPercent", cpuSample.CPUIOWaitPercent)
+			entries = data.appendMetric(entries, "CpuIdlePercent", cpuSample.CPUIdlePercent)
+			entries = data.appendMetric(entries, "CpuStealPercent", cpuSample.CPUStealPercent)
+			entries = data.appendMetric(entries, "CpuNicePercent", cpuSample.CPUNicePercent)
+			entries = data.appendMetric(entries, "CpuIrqPercent", cpuSample.CPUIrqPercent)
+			entries = data.appendMetric(entries, "CpuSoftirqPercent", cpuSample.CPUSoftirqPercent)
+			entries = data.appendMetric(entries, "CpuGuestPercent", cpuSample.CPUGuestPercent)
+		}
+		if data.PerCPU {
+			cpuCoreSamples, err = cpuMonitor.SamplePerCPU()
+			if err != nil {
+				log.Printf("Error: cpuMonitor per-CPU %v", err)
+			}
+			for _, cs := range cpuCoreSamples {
+				core := map[string]string{"cpu": cs.CPU}
+				entries = data.appendMetricAttributes(entries, "CpuCorePercent", cs.CPUPercent, core)
+				entries = data.appendMetricAttributes(entries, "CpuCoreUserPercent", cs.CPUUserPercent, core)
+				entries = data.appendMetricAttributes(entries, "CpuCoreSystemPercent", cs.CPUSystemPercent, core)
+				entries = data.appendMetricAttributes(entries, "CpuCoreIOWaitPercent", cs.CPUIOWaitPercent, core)
+				entries = data.appendMetricAttributes(entries, "CpuCoreStealPercent", cs.CPUStealPercent, core)
+			}
+		}
+		if cgroupCPUMonitor != nil {
+			cgroupCPUSample, err = cgroupCPUMonitor.Sample()
+			if err != nil {
+				log.Printf("Error: cgroupCPUMonitor %v", err)
+			} else {
+				entries = data.appendMetric(entries, "CgroupCpuUsageCores", cgroupCPUSample.UsageCores)
+				entries = data.appendMetric(entries, "CgroupCpuLimitCores", cgroupCPUSample.LimitCores)
+				entries = data.appendMetric(entries, "CgroupCpuUsedPercent", cgroupCPUSample.UsedPercent)
+				entries = data.appendMetric(entries, "CgroupCpuPeriods", cgroupCPUSample.Periods)
+				entries = data.appendMetric(entries, "CgroupCpuThrottledPeriods", cgroupCPUSample.ThrottledPeriods)
+				entries = data.appendMetric(entries, "CgroupCpuThrottledPercent", cgroupCPUSample.ThrottledPercent)
+				entries = data.appendMetric(entries, "CgroupCpuThrottledSeconds", cgroupCPUSample.ThrottledSeconds)
+			}
 		}
+
+		loadAvg, err = loadMonitor.Sample()
+		if err != nil {
+			log.Printf("Error: loadMonitor %v", err)
+		} else {
+			entries = data.appendMetric(entries, "LoadAverageOneMinute", loadAvg.Load1)
+			entries = data.appendMetric(entries, "LoadAverageFiveMinute", loadAvg.Load5)
+			entries = data.appendMetric(entries, "LoadAverageFifteenMinute", loadAvg.Load15)
+			entries = data.appendMetric(entries, "LoadAverageOneMinutePerCpu", loadAvg.Load1PerCPU)
+			entries = data.appendMetric(entries, "LoadAverageFiveMinutePerCpu", loadAvg.Load5PerCPU)
+			entries = data.appendMetric(entries, "LoadAverageFifteenMinutePerCpu", loadAvg.Load15PerCPU)
+			entries = data.appendMetric(entries, "ProcsRunning", loadAvg.ProcsRunning)
+			entries = data.appendMetric(entries, "ProcsBlocked", loadAvg.ProcsBlocked)
+		}
+		if pressureMonitor != nil {
+			pressureSamples, err = pressureMonitor.Sample()
+			if err != nil {
+				log.Printf("Error: pressureMonitor %v", err)
+			}
+			for _, ps := range pressureSamples {
+				pressure := map[string]string{"resource": ps.Resource, "stall": ps.Stall, "scope": ps.Scope}
+				entries = data.appendMetricAttributes(entries, "PressureAvg10", ps.Avg10, pressure)
+				entries = data.appendMetricAttributes(entries, "PressureAvg60", ps.Avg60, pressure)
+				entries = data.appendMetricAttributes(entries, "PressureAvg300", ps.Avg300, pressure)
+				entries = data.appendMetricAttributes(entries, "PressureStallMsPerSec", ps.StallMsPerSec, pressure)
+			}
+		}
+
 		memSample, err = memoryMonitor.Sample()
 		if err != nil {
 			log.Printf("Error: memoryMonitor %v", err)
 		} else {
-			entries = append(entries, data.makeMetric("MemoryTotalBytes", memSample.MemoryTotal))
-			entries = append(entries, data.makeMetric("MemoryFreeBytes", memSample.MemoryFree))
-			entries = append(entries, data.makeMetric("MemoryUsedBytes", memSample.MemoryUsed))
-			entries = append(entries, data.makeMetric("MemoryFreePercent", memSample.MemoryFreePercent))
-			entries = append(entries, data.makeMetric("MemoryUsedPercent", memSample.MemoryUsedPercent))
-			entries = append(entries, data.makeMetric("MemoryCachedBytes", memSample.MemoryCachedBytes))
-			entries = append(entries, data.makeMetric("SwapTotalBytes", memSample.SwapTotal))
-			entries = append(entries, data.makeMetric("SwapFreeBytes", memSample.SwapFree))
-			entries = append(entries, data.makeMetric("SwapUsedBytes", memSample.SwapUsed))
+			entries = data.appendMetric(entries, "MemoryTotalBytes", memSample.MemoryTotal)
+			entries = data.appendMetric(entries, "MemoryFreeBytes", memSample.MemoryFree)
+			entries = data.appendMetric(entries, "MemoryUsedBytes", memSample.MemoryUsed)
+			entries = data.appendMetric(entries, "MemoryFreePercent", memSample.MemoryFreePercent)
+			entries = data.appendMetric(entries, "MemoryUsedPercent", memSample.MemoryUsedPercent)
+			entries = data.appendMetric(entries, "MemoryCachedBytes", memSample.MemoryCachedBytes)
+			entries = data.appendMetric(entries, "SwapTotalBytes", memSample.SwapTotal)
+			entries = data.appendMetric(entries, "SwapFreeBytes", memSample.SwapFree)
+			entries = data.appendMetric(entries, "SwapUsedBytes", memSample.SwapUsed)
+		}
+
+		if cgroupMemoryMonitor != nil {
+			cgroupMemSample, err = cgroupMemoryMonitor.Sample()
+			if err != nil {
+				log.Printf("Error: cgroupMemoryMonitor %v", err)
+			} else {
+				entries = data.appendMetric(entries, "CgroupMemoryLimitBytes", cgroupMemSample.LimitBytes)
+				entries = data.appendMetric(entries, "CgroupMemoryUsageBytes", cgroupMemSample.UsageBytes)
+				entries = data.appendMetric(entries, "CgroupMemoryWorkingSetBytes", cgroupMemSample.WorkingSetBytes)
+				entries = data.appendMetric(entries, "CgroupMemoryAnonBytes", cgroupMemSample.AnonBytes)
+				entries = data.appendMetric(entries, "CgroupMemoryFileBytes", cgroupMemSample.FileBytes)
+				entries = data.appendMetric(entries, "CgroupMemoryActiveFileBytes", cgroupMemSample.ActiveFileBytes)
+				entries = data.appendMetric(entries, "CgroupMemoryInactiveFileBytes", cgroupMemSample.InactiveFileBytes)
+				entries = data.appendMetric(entries, "CgroupMemoryOomEvents", cgroupMemSample.OomEvents)
+				entries = data.appendMetric(entries, "CgroupMemoryOomKillEvents", cgroupMemSample.OomKillEvents)
+				entries = data.appendMetric(entries, "CgroupMemoryHighEvents", cgroupMemSample.HighEvents)
+				entries = data.appendMetric(entries, "CgroupMemoryMaxEvents", cgroupMemSample.MaxEvents)
+			}
+		}
+
+		if processMonitor != nil {
+			processSamples, err = processMonitor.Sample()
+			if err != nil {
+				log.Printf("Error: processMonitor %v", err)
+			}
+			for _, ps := range processSamples {
+				process := map[string]string{
+					"pid":         strconv.Itoa(int(ps.Pid)),
+					"processName": ps.Name,
+					"commandLine": ps.CommandLine,
+					"user":        ps.User,
+				}
+				entries = data.appendMetricAttributes(entries, "ProcessCpuPercent", ps.CPUPercent, process)
+				entries = data.appendMetricAttributes(entries, "ProcessMemoryResidentBytes", ps.RSSBytes, process)
+				entries = data.appendMetricAttributes(entries, "ProcessMemoryVirtualBytes", ps.VMSBytes, process)
+				entries = data.appendMetricAttributes(entries, "ProcessThreadCount", ps.Threads, process)
+				entries = data.appendMetricAttributes(entries, "ProcessOpenFdCount", ps.OpenFDs, process)
+				if ps.HasIO {
+					entries = data.appendMetricAttributes(entries, "ProcessIoReadBytesPerSec", ps.ReadBytesPerSec, process)
+					entries = data.appendMetricAttributes(entries, "ProcessIoWriteBytesPerSec", ps.WriteBytesPerSec, process)
+				}
+			}
+		}
+
+		if processWatcher != nil {
+			watchSamples, err = processWatcher.Sample()
+			if err != nil {
+				log.Printf("Error: processWatcher %v", err)
+			}
+			for _, ws := range watchSamples {
+				watch := map[string]string{"watchName": ws.Name}
+				entries = data.appendMetricAttributes(entries, "ProcessWatchUp", ws.Up, watch)
+				entries = data.appendMetricAttributes(entries, "ProcessWatchInstanceCount", ws.Instances, watch)
+				entries = data.appendMetricAttributes(entries, "ProcessWatchCpuPercent", ws.CPUPercent, watch)
+				entries = data.appendMetricAttributes(entries, "ProcessWatchMemoryResidentBytes", ws.RSSBytes, watch)
+				entries = data.appendMetricAttributes(entries, "ProcessWatchRestarts", ws.Restarts, watch)
+			}
 		}
 
 		netSample, err = networkMonitor.Sample()
@@ -158,10 +410,51 @@ func main() {
 			log.Printf("Error: networkMonitor %v", err)
 		} else {
 			for _, sample := range netSample {
-				entries = append(entries, data.getNetworkMetric(sample, "ReceiveBytesPerSec"))
-				entries = append(entries, data.getNetworkMetric(sample, "ReceiveErrorsPerSec"))
-				entries = append(entries, data.getNetworkMetric(sample, "TransmitBytesPerSec"))
-				entries = append(entries, data.getNetworkMetric(sample, "TransmitErrorsPerSec"))
+				entries = data.appendNetworkMetrics(entries, sample)
+			}
+		}
+
+		if socketMonitor != nil {
+			socketSample, err = socketMonitor.Sample()
+			if err != nil {
+				log.Printf("Error: socketMonitor %v", err)
+			} else {
+				entries = data.appendMetric(entries, "SocketsUsed", socketSample.SocketsUsed)
+				entries = data.appendMetric(entries, "SocketTcpInUse", socketSample.TcpInUse)
+				entries = data.appendMetric(entries, "SocketTcp6InUse", socketSample.Tcp6InUse)
+				entries = data.appendMetric(entries, "SocketTcpOrphans", socketSample.TcpOrphans)
+				entries = data.appendMetric(entries, "SocketTcpTimeWait", socketSample.TcpTimeWait)
+				entries = data.appendMetric(entries, "SocketTcpAllocated", socketSample.TcpAllocated)
+				entries = data.appendMetric(entries, "SocketTcpMemoryBytes", socketSample.TcpMemoryBytes)
+				entries = data.appendMetric(entries, "SocketUdpInUse", socketSample.UdpInUse)
+				entries = data.appendMetric(entries, "SocketUdp6InUse", socketSample.Udp6InUse)
+				entries = data.appendMetric(entries, "SocketUdpMemoryBytes", socketSample.UdpMemoryBytes)
+				for state, count := range socketSample.TcpStates {
+					entries = data.appendMetricAttributes(entries, "TcpConnectionCount", count, map[string]string{"state": state})
+				}
+				for port, count := range socketSample.PortConnections {
+					entries = data.appendMetricAttributes(entries, "TcpPortConnectionCount", count, map[string]string{"port": strconv.Itoa(port)})
+				}
+			}
+		}
+
+		if protocolMonitor != nil {
+			protocolSamples, err = protocolMonitor.Sample()
+			if err != nil {
+				log.Printf("Error: protocolMonitor %v", err)
+			}
+			for _, ps := range protocolSamples {
+				entries = data.appendMetric(entries, ps.Counter+"PerSec", ps.RatePerSec)
+			}
+		}
+
+		if dockerMonitor != nil {
+			dockerSamples, err = dockerMonitor.Sample()
+			if err != nil {
+				log.Printf("Error: dockerMonitor %v", err)
+			}
+			for _, ds := range dockerSamples {
+				entries = data.appendDockerMetrics(entries, ds)
 			}
 		}
 
@@ -170,23 +463,46 @@ func main() {
 			log.Printf("Error: storageMonitor %v", err)
 		} else {
 			for _, ss := range storageSample {
-				entries = append(entries, data.getStorageMetric(ss, "UsedBytes"))
-				entries = append(entries, data.getStorageMetric(ss, "UsedPercent"))
-				entries = append(entries, data.getStorageMetric(ss, "FreeBytes"))
-				entries = append(entries, data.getStorageMetric(ss, "FreePercent"))
-				entries = append(entries, data.getStorageMetric(ss, "TotalBytes"))
-				entries = append(entries, data.getStorageMetric(ss, "ReadBytesPerSec"))
-				entries = append(entries, data.getStorageMetric(ss, "WriteBytesPerSec"))
-				entries = append(entries, data.getStorageMetric(ss, "ReadWriteBytesPerSecond"))
+				entries = data.appendStorageMetrics(entries, ss.(*Sample))
 			}
 		}
 
-		// Format for metrics API
-		b := compressPayload(Payload{entries})
+		// Format for metrics API, split to stay within size limits
+		payloads := buildPayloads(Payload{data.makeCommon(), entries})
 
-		// Post to API
-		_ = retryQuery(client, "POST", NrMetricApi, b, headers)
-		//log.Printf("Metrics api response %s", resp)
+		// Post to API, retrying no longer than the poll interval
+		deadline := startTime.Add(data.PollInterval)
+		send := func(b []byte) ([][]byte, [][]byte, error) {
+			return sender.Post(b, deadline)
+		}
+
+		// Spool the parts that couldn't be delivered, parts the API rejected outright are dropped
+		for _, b := range payloads {
+			var rejected, pending [][]byte
+			if spool == nil {
+				rejected, _, err = send(b)
+			} else if spool.Pending() {
+				// Queue behind older payloads so they are replayed in order
+				err = spool.Store(b)
+				if err == nil {
+					_, err = spool.Replay(send, deadline)
+				}
+			} else {
+				rejected, pending, err = send(b)
+				for _, part := range pending {
+					if storeErr := spool.Store(part); storeErr != nil {
+						log.Printf("Error: spool store %v", storeErr)
+						break
+					}
+				}
+			}
+			if err != nil {
+				log.Printf("Error: metrics api %v", err)
+			}
+			if len(rejected) > 0 {
+				log.Printf("Error: metrics api rejected %d payloads, dropped", len(rejected))
+			}
+		}
 
 		remainder := data.PollInterval - time.Now().Sub(startTime)
 		if remainder > 0 {
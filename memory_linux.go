@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/newrelic/infrastructure-agent/pkg/helpers"
 	"github.com/shirou/gopsutil/mem"
 )
 
@@ -26,7 +27,7 @@ func NewMemoryMonitor() *MemoryMonitor {
 // Available Memory (kernels < 3.14): MemFree + Buffers + Cached
 // Used Memory: Total Memory - Available Memory
 func reclaimableAsUsed() (*mem.VirtualMemoryStat, error) {
-	filename := "/proc/meminfo"
+	filename := helpers.HostProc("meminfo")
 	return reclaimableAsUsedParseMemInfo(filename)
 }
 
@@ -1,33 +1,187 @@
 package main
 
 import (
+	"fmt"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/newrelic/infrastructure-agent/pkg/metrics/acquire"
 	"github.com/newrelic/infrastructure-agent/pkg/metrics/network"
 )
 
-type NetworkSample *network.NetworkSample
+// NetworkSample adds the /proc/net/dev error counters the agent sampler leaves out
+type NetworkSample struct {
+	*network.NetworkSample
+
+	ReceiveFifoErrorsPerSec     *float64 `json:"receiveFifoErrorsPerSecond,omitempty"`
+	ReceiveFrameErrorsPerSec    *float64 `json:"receiveFrameErrorsPerSecond,omitempty"`
+	TransmitFifoErrorsPerSec    *float64 `json:"transmitFifoErrorsPerSecond,omitempty"`
+	TransmitCollisionsPerSec    *float64 `json:"transmitCollisionsPerSecond,omitempty"`
+	TransmitCarrierErrorsPerSec *float64 `json:"transmitCarrierErrorsPerSecond,omitempty"`
+}
+
+// Cumulative counters from /proc/net/dev that gopsutil does not return
+type netDevCounters struct {
+	rxFifo    uint64
+	rxFrame   uint64
+	txFifo    uint64
+	txColls   uint64
+	txCarrier uint64
+}
+
+// Interfaces to report, by glob patterns on the name and by state
+type InterfaceFilter struct {
+	Include       []string
+	Exclude       []string
+	SkipDown      bool
+	SkipNoAddress bool
+}
+
+type NetworkMonitor struct {
+	filter   InterfaceFilter
+	sampler  network.NetworkSampler
+	lastDev  map[string]netDevCounters
+	lastTime time.Time
+}
+
+func NewNetworkMonitor(filter InterfaceFilter) *NetworkMonitor {
+	return &NetworkMonitor{filter: filter}
+}
+
+func (nm *NetworkMonitor) Sample() (samples []*NetworkSample, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("Panic in NetworkMonitor.Sample: %v\nStack: %s", panicErr, debug.Stack())
+		}
+	}()
 
-func NewNetworkMonitor() network.NetworkSampler {
-	return network.NetworkSampler{}
+	batch, err := nm.sampler.Sample()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	dev, err := readNetDev()
+	if err != nil {
+		return nil, err
+	}
+	elapsed := now.Sub(nm.lastTime).Seconds()
+
+	for _, event := range batch {
+		ns := event.(*network.NetworkSample)
+		if !nm.filter.match(ns) {
+			continue
+		}
+		sample := &NetworkSample{NetworkSample: ns}
+		current, ok := dev[sample.InterfaceName]
+		if last, seen := nm.lastDev[sample.InterfaceName]; ok && seen {
+			sample.ReceiveFifoErrorsPerSec = netRate(current.rxFifo, last.rxFifo, elapsed)
+			sample.ReceiveFrameErrorsPerSec = netRate(current.rxFrame, last.rxFrame, elapsed)
+			sample.TransmitFifoErrorsPerSec = netRate(current.txFifo, last.txFifo, elapsed)
+			sample.TransmitCollisionsPerSec = netRate(current.txColls, last.txColls, elapsed)
+			sample.TransmitCarrierErrorsPerSec = netRate(current.txCarrier, last.txCarrier, elapsed)
+		}
+		samples = append(samples, sample)
+	}
+	nm.lastDev = dev
+	nm.lastTime = now
+	return
 }
 
-func (data *ConfigData) getNetworkMetric(sample interface{}, name string) (metric Metric) {
-	var value float64
-	ns := sample.(*network.NetworkSample)
+// Excludes win over includes, no include patterns means every interface
+func (filter InterfaceFilter) match(ns *network.NetworkSample) bool {
+	if filter.SkipDown && ns.State != network.STATE_UP {
+		return false
+	}
+	if filter.SkipNoAddress && len(ns.IpV4Address) == 0 && len(ns.IpV6Address) == 0 {
+		return false
+	}
+	if matchAny(filter.Exclude, ns.InterfaceName) {
+		return false
+	}
+	return len(filter.Include) == 0 || matchAny(filter.Include, ns.InterfaceName)
+}
+
+// Patterns are validated when config is read
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// /proc/net is the network namespace of the process reading it. Under a host root, the host's
+// is read through its PID 1 instead, which needs hostPID but not hostNetwork.
+func netNamespacePid(hostRoot string) string {
+	if len(hostRoot) > 0 {
+		return "1"
+	}
+	return "self"
+}
+
+func netRate(current, last uint64, elapsed float64) *float64 {
+	rate := acquire.CalculateSafeDelta(current, last, elapsed)
+	return &rate
+}
+
+var networkMetricNames = []string{
+	"ReceiveBytesPerSec", "ReceivePacketsPerSec", "ReceiveErrorsPerSec", "ReceiveDroppedPerSec",
+	"ReceiveFifoErrorsPerSec", "ReceiveFrameErrorsPerSec",
+	"TransmitBytesPerSec", "TransmitPacketsPerSec", "TransmitErrorsPerSec", "TransmitDroppedPerSec",
+	"TransmitFifoErrorsPerSec", "TransmitCollisionsPerSec", "TransmitCarrierErrorsPerSec",
+}
+
+// Append every interface counter, with the interface attributes.
+// Rates are nil on the first poll and for new interfaces, and are skipped rather than sent as 0.
+func (data *ConfigData) appendNetworkMetrics(entries []Metric, ns *NetworkSample) []Metric {
+	attributes := map[string]string{
+		"interfaceName":   ns.InterfaceName,
+		"hardwareAddress": ns.HardwareAddress,
+		"ipV4Address":     ns.IpV4Address,
+		"ipV6Address":     ns.IpV6Address,
+		"state":           ns.State,
+	}
+	for _, name := range networkMetricNames {
+		value := getNetworkValue(ns, name)
+		if value == nil {
+			continue
+		}
+		entries = data.appendMetricAttributes(entries, "Network"+name, *value, attributes)
+	}
+	return entries
+}
 
-	if name == "ReceiveBytesPerSec" && ns.ReceiveBytesPerSec != nil {
-		value = *ns.ReceiveBytesPerSec
-	} else if name == "ReceiveErrorsPerSec" && ns.ReceiveErrorsPerSec != nil {
-		value = *ns.ReceiveErrorsPerSec
-	} else if name == "TransmitBytesPerSec" && ns.TransmitBytesPerSec != nil {
-		value = *ns.TransmitBytesPerSec
-	} else if name == "TransmitErrorsPerSec" && ns.TransmitErrorsPerSec != nil {
-		value = *ns.TransmitErrorsPerSec
+// Rates are nil until the second sample of an interface
+func getNetworkValue(ns *NetworkSample, name string) (value *float64) {
+	switch name {
+	case "ReceiveBytesPerSec":
+		value = ns.ReceiveBytesPerSec
+	case "ReceivePacketsPerSec":
+		value = ns.ReceivePacketsPerSec
+	case "ReceiveErrorsPerSec":
+		value = ns.ReceiveErrorsPerSec
+	case "ReceiveDroppedPerSec":
+		value = ns.ReceiveDroppedPerSec
+	case "ReceiveFifoErrorsPerSec":
+		value = ns.ReceiveFifoErrorsPerSec
+	case "ReceiveFrameErrorsPerSec":
+		value = ns.ReceiveFrameErrorsPerSec
+	case "TransmitBytesPerSec":
+		value = ns.TransmitBytesPerSec
+	case "TransmitPacketsPerSec":
+		value = ns.TransmitPacketsPerSec
+	case "TransmitErrorsPerSec":
+		value = ns.TransmitErrorsPerSec
+	case "TransmitDroppedPerSec":
+		value = ns.TransmitDroppedPerSec
+	case "TransmitFifoErrorsPerSec":
+		value = ns.TransmitFifoErrorsPerSec
+	case "TransmitCollisionsPerSec":
+		value = ns.TransmitCollisionsPerSec
+	case "TransmitCarrierErrorsPerSec":
+		value = ns.TransmitCarrierErrorsPerSec
 	}
-	metric = data.makeMetric("Network" + name, value)
-	metric["attributes"].(map[string]string)["interfaceName"] = ns.InterfaceName
-	metric["attributes"].(map[string]string)["hardwareAddress"] = ns.HardwareAddress
-	metric["attributes"].(map[string]string)["ipV4Address"] = ns.IpV4Address
-	metric["attributes"].(map[string]string)["ipV6Address"] = ns.IpV6Address
-	metric["attributes"].(map[string]string)["state"] = ns.State
 	return
 }
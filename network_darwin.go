@@ -0,0 +1,6 @@
+package main
+
+// Darwin has no /proc/net/dev, only the counters from the agent sampler are reported
+func readNetDev() (map[string]netDevCounters, error) {
+	return nil, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/newrelic/infrastructure-agent/pkg/helpers"
+)
+
+func readNetDev() (map[string]netDevCounters, error) {
+	return parseNetDev(helpers.HostProc("net", "dev"))
+}
+
+// After two header lines, each interface has 8 receive then 8 transmit counters:
+// "eth0: bytes packets errs drop fifo frame compressed multicast bytes packets errs drop fifo colls carrier compressed"
+func parseNetDev(filename string) (counters map[string]netDevCounters, err error) {
+	var f *os.File
+
+	f, err = os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	counters = map[string]netDevCounters{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) < 16 {
+			continue
+		}
+		values := make([]uint64, 16)
+		for i := range values {
+			values[i], err = strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		}
+		counters[strings.TrimSpace(parts[0])] = netDevCounters{
+			rxFifo:    values[4],
+			rxFrame:   values[5],
+			txFifo:    values[12],
+			txColls:   values[13],
+			txCarrier: values[14],
+		}
+	}
+	err = scanner.Err()
+	return
+}
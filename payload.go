@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// Metric API limits per POST
+const (
+	MaxPayloadBytes             = 1000000
+	MaxUncompressedPayloadBytes = 10000000
+)
+
+// Compress the payload, splitting it in half until each part is within the Metric API limits
+func buildPayloads(payload Payload) (payloads [][]byte) {
+	b, size := compressPayload(payload)
+	if len(b) <= MaxPayloadBytes && size <= MaxUncompressedPayloadBytes {
+		return [][]byte{b}
+	}
+	if len(payload.Metrics) <= 1 {
+		log.Printf("Error: single metric exceeds payload limit, length %d compressed %d", size, len(b))
+		return [][]byte{b}
+	}
+
+	first, second := splitPayload(payload)
+	payloads = append(buildPayloads(first), buildPayloads(second)...)
+	if DebugLog {
+		log.Printf("Split payload of %d metrics in %d posts", len(payload.Metrics), len(payloads))
+	}
+	return
+}
+
+// Divide the metrics between two payloads
+func splitPayload(payload Payload) (first, second Payload) {
+	half := len(payload.Metrics) / 2
+	first.Common = payload.Common
+	second.Common = payload.Common
+	first.Metrics = payload.Metrics[:half]
+	second.Metrics = payload.Metrics[half:]
+	return
+}
+
+// Split an already compressed payload in two, for when the API responds 413
+func splitCompressed(b []byte) (parts [][]byte, err error) {
+	var gz *gzip.Reader
+	var j []byte
+	var payloads []Payload
+
+	gz, err = gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	j, err = ioutil.ReadAll(gz)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(j, &payloads)
+	if err != nil {
+		return
+	}
+	if len(payloads) != 1 || len(payloads[0].Metrics) <= 1 {
+		return nil, fmt.Errorf("payload has only one metric")
+	}
+
+	first, second := splitPayload(payloads[0])
+	for _, payload := range []Payload{first, second} {
+		part, _ := compressPayload(payload)
+		parts = append(parts, part)
+	}
+	return
+}
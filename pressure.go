@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/newrelic/infrastructure-agent/pkg/helpers"
+)
+
+var pressureResources = []string{"cpu", "memory", "io"}
+
+// Pressure Stall Information for one resource, stall is "some" or "full" and scope is "host" or "cgroup"
+type PressureSample struct {
+	Resource      string  `json:"resource"`
+	Stall         string  `json:"stall"`
+	Scope         string  `json:"scope"`
+	Avg10         float64 `json:"avg10"`
+	Avg60         float64 `json:"avg60"`
+	Avg300        float64 `json:"avg300"`
+	StallMsPerSec float64 `json:"stallMsPerSec"`
+}
+
+type pressureSource struct {
+	scope    string
+	resource string
+	filename string
+}
+
+type PressureMonitor struct {
+	sources   []pressureSource
+	lastTotal map[string]uint64
+	lastTime  time.Time
+}
+
+// NewPressureMonitor probes /proc/pressure, and the cgroup when given, for the PSI files this kernel provides.
+// Returns an error when there are none, so the caller can disable PSI metrics instead of failing every poll.
+func NewPressureMonitor(cgroup *Cgroup) (*PressureMonitor, error) {
+	pm := &PressureMonitor{}
+	for _, resource := range pressureResources {
+		pm.probe("host", resource, helpers.HostProc("pressure", resource))
+		// Only the v2 hierarchy has pressure files
+		if cgroup != nil && cgroup.Version == 2 {
+			pm.probe("cgroup", resource, cgroup.Path(resource, resource+".pressure"))
+		}
+	}
+	if len(pm.sources) == 0 {
+		return nil, fmt.Errorf("kernel has no pressure stall information")
+	}
+	return pm, nil
+}
+
+// Kernels built without PSI have no files, and booted with psi=0 fail to read them
+func (pm *PressureMonitor) probe(scope, resource, filename string) {
+	if _, err := parsePressure(filename); err != nil {
+		return
+	}
+	pm.sources = append(pm.sources, pressureSource{scope: scope, resource: resource, filename: filename})
+}
+
+func (pm *PressureMonitor) Sample() (samples []*PressureSample, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("Panic in PressureMonitor.Sample: %v\nStack: %s", panicErr, debug.Stack())
+		}
+	}()
+
+	now := time.Now()
+	elapsed := now.Sub(pm.lastTime).Seconds()
+	totals := map[string]uint64{}
+	for _, source := range pm.sources {
+		lines, err := parsePressure(source.filename)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			key := source.filename + " " + line.stall
+			totals[key] = line.total
+
+			sample := &PressureSample{
+				Resource: source.resource,
+				Stall:    line.stall,
+				Scope:    source.scope,
+				Avg10:    line.avg10,
+				Avg60:    line.avg60,
+				Avg300:   line.avg300,
+			}
+			// total is cumulative stall time in microseconds
+			if last, ok := pm.lastTotal[key]; ok && line.total >= last && elapsed > 0 {
+				sample.StallMsPerSec = float64(line.total-last) / 1000 / elapsed
+			}
+			samples = append(samples, sample)
+		}
+	}
+	pm.lastTotal = totals
+	pm.lastTime = now
+	return
+}
+
+type pressureLine struct {
+	stall  string
+	avg10  float64
+	avg60  float64
+	avg300 float64
+	total  uint64
+}
+
+// Lines look like "some avg10=0.00 avg60=0.00 avg300=0.00 total=0"
+func parsePressure(filename string) (lines []pressureLine, err error) {
+	var f *os.File
+
+	f, err = os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 5 {
+			continue
+		}
+		line := pressureLine{stall: fields[0]}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "avg10":
+				line.avg10, err = strconv.ParseFloat(kv[1], 64)
+			case "avg60":
+				line.avg60, err = strconv.ParseFloat(kv[1], 64)
+			case "avg300":
+				line.avg300, err = strconv.ParseFloat(kv[1], 64)
+			case "total":
+				line.total, err = strconv.ParseUint(kv[1], 10, 64)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		lines = append(lines, line)
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/newrelic/infrastructure-agent/pkg/helpers"
+)
+
+const (
+	DefaultProcessTopN   = 10
+	ProcessCmdlineMaxLen = 256
+)
+
+type ProcessSample struct {
+	Pid              int32   `json:"pid"`
+	Name             string  `json:"processName"`
+	CommandLine      string  `json:"commandLine"`
+	User             string  `json:"user"`
+	CPUPercent       float64 `json:"cpuPercent"`
+	RSSBytes         float64 `json:"memoryResidentSizeBytes"`
+	VMSBytes         float64 `json:"memoryVirtualSizeBytes"`
+	Threads          float64 `json:"threadCount"`
+	OpenFDs          float64 `json:"fileDescriptorCount"`
+	ReadBytesPerSec  float64 `json:"ioReadBytesPerSecond"`
+	WriteBytesPerSec float64 `json:"ioWriteBytesPerSecond"`
+	HasIO            bool    `json:"-"`
+}
+
+// What we keep about a process between polls, one small entry per PID
+type procStat struct {
+	name      string
+	startTime uint64
+	cpuTicks  uint64
+	rss       uint64
+	vms       uint64
+	threads   uint64
+}
+
+type procIO struct {
+	startTime  uint64
+	readBytes  uint64
+	writeBytes uint64
+}
+
+// ProcessMonitor reports the top N processes by CPU and by memory.
+// Only the light /proc/[pid]/stat is read for every process, the rest only for the top N.
+type ProcessMonitor struct {
+	topN     int
+	last     map[int32]procStat
+	lastIO   map[int32]procIO
+	lastTime time.Time
+	users    map[uint32]string
+}
+
+func NewProcessMonitor(topN int) *ProcessMonitor {
+	return &ProcessMonitor{topN: topN, users: map[uint32]string{}}
+}
+
+func (pm *ProcessMonitor) Sample() (samples []*ProcessSample, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("Panic in ProcessMonitor.Sample: %v\nStack: %s", panicErr, debug.Stack())
+		}
+	}()
+
+	now := time.Now()
+	current, err := readProcStats()
+	if err != nil {
+		return nil, err
+	}
+	elapsed := now.Sub(pm.lastTime).Seconds()
+
+	// CPU percent of one core since the last poll, for processes seen both times
+	cpuPercent := make(map[int32]float64, len(current))
+	pids := make([]int32, 0, len(current))
+	for pid, stat := range current {
+		pids = append(pids, pid)
+		if last, ok := pm.last[pid]; ok && last.startTime == stat.startTime && stat.cpuTicks >= last.cpuTicks && elapsed > 0 {
+			cpuPercent[pid] = float64(stat.cpuTicks-last.cpuTicks) / clockTicks / elapsed * 100.0
+		}
+	}
+	pm.last = current
+	pm.lastTime = now
+
+	// Union of the top N by CPU and the top N by resident memory
+	top := map[int32]bool{}
+	sort.Slice(pids, func(i, j int) bool { return cpuPercent[pids[i]] > cpuPercent[pids[j]] })
+	for i := 0; i < len(pids) && i < pm.topN; i++ {
+		top[pids[i]] = true
+	}
+	sort.Slice(pids, func(i, j int) bool { return current[pids[i]].rss > current[pids[j]].rss })
+	for i := 0; i < len(pids) && i < pm.topN; i++ {
+		top[pids[i]] = true
+	}
+
+	lastIO := pm.lastIO
+	pm.lastIO = make(map[int32]procIO, len(top))
+	for pid := range top {
+		stat := current[pid]
+		sample := &ProcessSample{
+			Pid:        pid,
+			Name:       stat.name,
+			CPUPercent: cpuPercent[pid],
+			RSSBytes:   float64(stat.rss),
+			VMSBytes:   float64(stat.vms),
+			Threads:    float64(stat.threads),
+		}
+		// Process may exit while we read it, keep what we have
+		sample.CommandLine = scrubCommandLine(readProcCmdline(pid))
+		sample.User = pm.userName(readProcUid(pid))
+		sample.OpenFDs = float64(countProcFDs(pid))
+		if counters, err := readProcIO(pid); err == nil {
+			counters.startTime = stat.startTime
+			if last, ok := lastIO[pid]; ok && last.startTime == counters.startTime && elapsed > 0 &&
+				counters.readBytes >= last.readBytes && counters.writeBytes >= last.writeBytes {
+				sample.ReadBytesPerSec = float64(counters.readBytes-last.readBytes) / elapsed
+				sample.WriteBytesPerSec = float64(counters.writeBytes-last.writeBytes) / elapsed
+				sample.HasIO = true
+			}
+			pm.lastIO[pid] = counters
+		}
+		samples = append(samples, sample)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Pid < samples[j].Pid })
+	return
+}
+
+// Cache user names, there are far fewer users than processes
+func (pm *ProcessMonitor) userName(uid uint32, ok bool) string {
+	if !ok {
+		return ""
+	}
+	if name, found := pm.users[uid]; found {
+		return name
+	}
+	name := lookupUser(uid)
+	pm.users[uid] = name
+	return name
+}
+
+// Hide secrets passed as arguments, then truncate
+func scrubCommandLine(args []string) string {
+	cmdline := strings.Join(helpers.ObfuscateSensitiveDataFromArray(args), " ")
+	cmdline = helpers.SanitizeCommandLine(cmdline)
+	if len(cmdline) > ProcessCmdlineMaxLen {
+		// Cut at a character boundary, so the payload stays valid UTF-8
+		end := ProcessCmdlineMaxLen
+		for end > 0 && !utf8.RuneStart(cmdline[end]) {
+			end--
+		}
+		cmdline = cmdline[:end]
+	}
+	return cmdline
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const clockTicks = 100
+
+// Darwin has no /proc, process metrics are disabled when config is read
+const processMetricsSupported = false
+
+func readProcStats() (map[int32]procStat, error) {
+	return nil, fmt.Errorf("process metrics are not supported on darwin")
+}
+
+func readProcCmdline(_ int32) []string {
+	return nil
+}
+
+func readProcUid(_ int32) (uint32, bool) {
+	return 0, false
+}
+
+func countProcFDs(_ int32) int {
+	return 0
+}
+
+func readProcIO(_ int32) (procIO, error) {
+	return procIO{}, fmt.Errorf("process io is not supported on darwin")
+}
+
+func lookupUser(uid uint32) string {
+	return strconv.FormatUint(uint64(uid), 10)
+}
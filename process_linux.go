@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/newrelic/infrastructure-agent/pkg/helpers"
+)
+
+// USER_HZ, the unit of CPU times in /proc, is 100 on all supported architectures
+const clockTicks = 100
+
+const processMetricsSupported = true
+
+var pageSize = uint64(os.Getpagesize())
+
+// Read /proc/[pid]/stat for every process
+func readProcStats() (stats map[int32]procStat, err error) {
+	var entries []os.FileInfo
+
+	entries, err = ioutil.ReadDir(helpers.HostProc())
+	if err != nil {
+		return
+	}
+	stats = make(map[int32]procStat, len(entries))
+	for _, entry := range entries {
+		pid, err := strconv.ParseInt(entry.Name(), 10, 32)
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		stat, err := readProcStat(int32(pid))
+		if err != nil {
+			// Process exited since listing /proc
+			continue
+		}
+		stats[int32(pid)] = stat
+	}
+	return stats, nil
+}
+
+// The name is in parentheses and may contain spaces, the fields after it are numbered from 3 (state)
+func readProcStat(pid int32) (stat procStat, err error) {
+	var b []byte
+
+	b, err = ioutil.ReadFile(helpers.HostProc(strconv.Itoa(int(pid)), "stat"))
+	if err != nil {
+		return
+	}
+	start := bytes.IndexByte(b, '(')
+	end := bytes.LastIndexByte(b, ')')
+	if start < 0 || end < start {
+		return stat, fmt.Errorf("unexpected format in stat of pid %d", pid)
+	}
+	stat.name = string(b[start+1 : end])
+	fields := strings.Fields(string(b[end+1:]))
+	if len(fields) < 22 {
+		return stat, fmt.Errorf("unexpected format in stat of pid %d", pid)
+	}
+	field := func(n int) uint64 {
+		value, _ := strconv.ParseUint(fields[n-3], 10, 64)
+		return value
+	}
+	stat.cpuTicks = field(14) + field(15)
+	stat.threads = field(20)
+	stat.startTime = field(22)
+	stat.vms = field(23)
+	stat.rss = field(24) * pageSize
+	return
+}
+
+func readProcCmdline(pid int32) []string {
+	b, err := ioutil.ReadFile(helpers.HostProc(strconv.Itoa(int(pid)), "cmdline"))
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(bytes.Replace(b, []byte{0}, []byte{' '}, -1)))
+}
+
+// Real UID from the Uid line of /proc/[pid]/status
+func readProcUid(pid int32) (uid uint32, ok bool) {
+	f, err := os.Open(helpers.HostProc(strconv.Itoa(int(pid)), "status"))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "Uid:" {
+			value, err := strconv.ParseUint(fields[1], 10, 32)
+			return uint32(value), err == nil
+		}
+	}
+	return
+}
+
+func countProcFDs(pid int32) int {
+	f, err := os.Open(helpers.HostProc(strconv.Itoa(int(pid)), "fd"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	names, _ := f.Readdirnames(-1)
+	return len(names)
+}
+
+// Bytes read and written to storage, from /proc/[pid]/io, which needs the same user or root
+func readProcIO(pid int32) (counters procIO, err error) {
+	var b []byte
+
+	b, err = ioutil.ReadFile(helpers.HostProc(strconv.Itoa(int(pid)), "io"))
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		value, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "read_bytes:":
+			counters.readBytes = value
+		case "write_bytes:":
+			counters.writeBytes = value
+		}
+	}
+	return
+}
+
+// Users are looked up in the host's passwd file, as the process UIDs are the host's.
+// Without a host root, fall back to the system lookup for users that aren't in /etc/passwd.
+func lookupUser(uid uint32) string {
+	id := strconv.FormatUint(uint64(uid), 10)
+	if name, ok := lookupPasswd(helpers.HostEtc("passwd"), id); ok {
+		return name
+	}
+	if len(os.Getenv("HOST_ETC")) > 0 {
+		return id
+	}
+	u, err := user.LookupId(id)
+	if err != nil {
+		return id
+	}
+	return u.Username
+}
+
+// Find the name for a UID in a passwd file, lines are name:password:uid:gid:...
+func lookupPasswd(file, id string) (name string, ok bool) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) > 2 && fields[2] == id && !strings.HasPrefix(fields[0], "#") {
+			return fields[0], true
+		}
+	}
+	return
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A process to watch, matched by exactly one of process name, command line regex or pidfile
+type ProcessWatchConfig struct {
+	Name        string `yaml:"name" json:"name"`
+	ProcessName string `yaml:"process_name" json:"process_name"`
+	Cmdline     string `yaml:"cmdline" json:"cmdline"`
+	Pidfile     string `yaml:"pidfile" json:"pidfile"`
+}
+
+// Restarts counts the times the watched process was replaced or came back up, since infra-lite started
+type ProcessWatchSample struct {
+	Name       string  `json:"watchName"`
+	Up         float64 `json:"up"`
+	Instances  float64 `json:"instanceCount"`
+	CPUPercent float64 `json:"cpuPercent"`
+	RSSBytes   float64 `json:"memoryResidentSizeBytes"`
+	Restarts   float64 `json:"restarts"`
+}
+
+// A process instance is identified by PID and start time, as PIDs get reused
+type procIdentity struct {
+	pid       int32
+	startTime uint64
+}
+
+// The oldest matching instance is the one that counts for restarts, so workers and children
+// coming and going under it are not restarts
+type processWatch struct {
+	config   ProcessWatchConfig
+	cmdline  *regexp.Regexp
+	pidfile  string
+	sampled  bool
+	oldest   *procIdentity
+	restarts float64
+}
+
+type ProcessWatcher struct {
+	watches   []*processWatch
+	lastTicks map[procIdentity]uint64
+	lastTime  time.Time
+}
+
+// The kernel truncates process names to 15 characters in /proc/[pid]/stat
+const procNameMaxLen = 15
+
+// NewProcessWatcher checks the watches, pidfiles are read under the host root when there is one
+func NewProcessWatcher(configs []ProcessWatchConfig, hostRoot string) (pw *ProcessWatcher, err error) {
+	pw = &ProcessWatcher{}
+	for _, config := range configs {
+		matchers := 0
+		for _, m := range []string{config.ProcessName, config.Cmdline, config.Pidfile} {
+			if len(m) > 0 {
+				matchers++
+			}
+		}
+		if len(config.Name) == 0 || matchers != 1 {
+			return nil, fmt.Errorf("process watch [%s] needs a name and one of process_name, cmdline or pidfile", config.Name)
+		}
+
+		watch := &processWatch{config: config}
+		if len(config.Pidfile) > 0 {
+			watch.pidfile = filepath.Join("/", hostRoot, config.Pidfile)
+		}
+		if len(config.Cmdline) > 0 {
+			watch.cmdline, err = regexp.Compile(config.Cmdline)
+			if err != nil {
+				return nil, fmt.Errorf("process watch [%s] %v", config.Name, err)
+			}
+		}
+		pw.watches = append(pw.watches, watch)
+	}
+	return
+}
+
+func (pw *ProcessWatcher) Sample() (samples []*ProcessWatchSample, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("Panic in ProcessWatcher.Sample: %v\nStack: %s", panicErr, debug.Stack())
+		}
+	}()
+
+	now := time.Now()
+	stats, err := readProcStats()
+	if err != nil {
+		return nil, err
+	}
+	elapsed := now.Sub(pw.lastTime).Seconds()
+
+	// Command lines are only read when a watch needs them, and once per process
+	cmdlines := map[int32]string{}
+	cmdline := func(pid int32) string {
+		if c, ok := cmdlines[pid]; ok {
+			return c
+		}
+		c := strings.Join(readProcCmdline(pid), " ")
+		cmdlines[pid] = c
+		return c
+	}
+
+	ticks := map[procIdentity]uint64{}
+	for _, watch := range pw.watches {
+		var oldest *procIdentity
+		sample := &ProcessWatchSample{Name: watch.config.Name}
+
+		for _, pid := range watch.match(stats, cmdline) {
+			stat := stats[pid]
+			id := procIdentity{pid: pid, startTime: stat.startTime}
+			ticks[id] = stat.cpuTicks
+			if oldest == nil || id.startTime < oldest.startTime || (id.startTime == oldest.startTime && id.pid < oldest.pid) {
+				oldest = &procIdentity{pid: pid, startTime: stat.startTime}
+			}
+
+			sample.Instances++
+			sample.RSSBytes += float64(stat.rss)
+			if last, ok := pw.lastTicks[id]; ok && stat.cpuTicks >= last && elapsed > 0 {
+				sample.CPUPercent += float64(stat.cpuTicks-last) / clockTicks / elapsed * 100.0
+			}
+		}
+		if sample.Instances > 0 {
+			sample.Up = 1
+			// Nothing restarted on the first poll
+			if watch.sampled && (watch.oldest == nil || *watch.oldest != *oldest) {
+				watch.restarts++
+			}
+		}
+		sample.Restarts = watch.restarts
+		watch.oldest = oldest
+		watch.sampled = true
+		samples = append(samples, sample)
+	}
+	pw.lastTicks = ticks
+	pw.lastTime = now
+	return
+}
+
+// PIDs of the running processes this watch matches
+func (watch *processWatch) match(stats map[int32]procStat, cmdline func(int32) string) (pids []int32) {
+	if len(watch.pidfile) > 0 {
+		b, err := ioutil.ReadFile(watch.pidfile)
+		if err != nil {
+			return
+		}
+		// The PID is the first field, some pidfiles like postmaster.pid have more lines after it
+		fields := strings.Fields(string(b))
+		if len(fields) == 0 {
+			return
+		}
+		pid, err := strconv.ParseInt(fields[0], 10, 32)
+		if err != nil {
+			return
+		}
+		if _, ok := stats[int32(pid)]; ok {
+			pids = append(pids, int32(pid))
+		}
+		return
+	}
+
+	for pid, stat := range stats {
+		if watch.cmdline != nil {
+			if watch.cmdline.MatchString(cmdline(pid)) {
+				pids = append(pids, pid)
+			}
+		} else if watch.matchName(pid, stat.name) {
+			pids = append(pids, pid)
+		}
+	}
+	return
+}
+
+// Names longer than the kernel keeps are checked against the executable name in argv[0]
+func (watch *processWatch) matchName(pid int32, name string) bool {
+	processName := watch.config.ProcessName
+	if len(processName) <= procNameMaxLen {
+		return name == processName
+	}
+	if name != processName[:procNameMaxLen] {
+		return false
+	}
+	args := readProcCmdline(pid)
+	return len(args) > 0 && filepath.Base(args[0]) == processName
+}
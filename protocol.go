@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+var DefaultProtocolCounters = []string{
+	"TcpRetransSegs", "TcpExtListenOverflows", "TcpExtListenDrops",
+	"UdpRcvbufErrors", "UdpInErrors", "IpExtInNoRoutes",
+}
+
+// Per second rate of a kernel counter from /proc/net/snmp or /proc/net/netstat,
+// named by its section and field, e.g. TcpRetransSegs or TcpExtListenOverflows
+type ProtocolSample struct {
+	Counter    string  `json:"counter"`
+	RatePerSec float64 `json:"ratePerSec"`
+}
+
+type ProtocolMonitor struct {
+	counters []string
+	last     map[string]uint64
+	lastTime time.Time
+	missing  map[string]bool
+	netPid   string
+}
+
+func NewProtocolMonitor(counters []string, hostRoot string) *ProtocolMonitor {
+	return &ProtocolMonitor{counters: counters, missing: map[string]bool{}, netPid: netNamespacePid(hostRoot)}
+}
+
+// Counters the kernel does not have are logged once and skipped
+func (pm *ProtocolMonitor) Sample() (samples []*ProtocolSample, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("Panic in ProtocolMonitor.Sample: %v\nStack: %s", panicErr, debug.Stack())
+		}
+	}()
+
+	now := time.Now()
+	values, err := readProtocolCounters(pm.netPid)
+	if err != nil {
+		return nil, err
+	}
+	elapsed := now.Sub(pm.lastTime).Seconds()
+
+	current := map[string]uint64{}
+	for _, counter := range pm.counters {
+		value, ok := values[counter]
+		if !ok {
+			if !pm.missing[counter] {
+				log.Printf("Warning: protocol counter [%s] not found", counter)
+				pm.missing[counter] = true
+			}
+			continue
+		}
+		current[counter] = value
+		if last, ok := pm.last[counter]; ok && value >= last && elapsed > 0 {
+			samples = append(samples, &ProtocolSample{Counter: counter, RatePerSec: float64(value-last) / elapsed})
+		}
+	}
+	pm.last = current
+	pm.lastTime = now
+	return
+}
@@ -0,0 +1,7 @@
+package main
+
+import "fmt"
+
+func readProtocolCounters(_ string) (map[string]uint64, error) {
+	return nil, fmt.Errorf("protocol metrics are not supported on darwin")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/newrelic/infrastructure-agent/pkg/helpers"
+)
+
+// Read the counters of the network namespace of pid
+func readProtocolCounters(pid string) (values map[string]uint64, err error) {
+	values = map[string]uint64{}
+	err = parseProtocolCounters(helpers.HostProc(pid, "net", "snmp"), values)
+	if err != nil {
+		return nil, err
+	}
+	err = parseProtocolCounters(helpers.HostProc(pid, "net", "netstat"), values)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Sections are a line of field names followed by a line of values, both starting with the section:
+// "Tcp: RtoAlgorithm RtoMin ..." then "Tcp: 1 200 ...". Negative values, like Tcp MaxConn -1, are skipped.
+func parseProtocolCounters(filename string, values map[string]uint64) (err error) {
+	var f *os.File
+	var header []string
+
+	f, err = os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if header == nil || header[0] != fields[0] {
+			header = fields
+			continue
+		}
+		section := strings.TrimSuffix(fields[0], ":")
+		for i := 1; i < len(fields) && i < len(header); i++ {
+			value, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				continue
+			}
+			values[section+header[i]] = value
+		}
+		header = nil
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SenderMaxAttempts = 5
+	SenderBaseDelay   = 500 * time.Millisecond
+	SenderMaxDelay    = 30 * time.Second
+)
+
+// Sender posts payloads to the Metric API, retrying transient errors with backoff
+type Sender struct {
+	client  *http.Client
+	url     string
+	headers []string
+}
+
+// HTTPError is returned when the API responds with a status other than 200 or 202
+type HTTPError struct {
+	StatusCode int
+	RequestId  string
+	RetryAfter time.Duration
+}
+
+// Metric API response body
+type apiResponse struct {
+	RequestId string `json:"requestId"`
+}
+
+func (e *HTTPError) Error() string {
+	if len(e.RequestId) > 0 {
+		return fmt.Sprintf("http status %d, requestId %s", e.StatusCode, e.RequestId)
+	}
+	return fmt.Sprintf("http status %d", e.StatusCode)
+}
+
+// Permanent errors will fail the same way if retried
+func (e *HTTPError) Permanent() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+func isPermanent(err error) bool {
+	httpErr, ok := err.(*HTTPError)
+	return ok && httpErr.Permanent()
+}
+
+func NewSender(client *http.Client, url string, headers []string) *Sender {
+	return &Sender{client: client, url: url, headers: headers}
+}
+
+// Post sends the payload, splitting it in half each time the API reports it too large.
+// Parts the API rejects outright are returned in rejected and not tried again. A transient error
+// stops the post, and pending holds the parts not yet delivered, so parts already accepted aren't sent again.
+func (s *Sender) Post(data []byte, deadline time.Time) (rejected, pending [][]byte, err error) {
+	err = s.postRetry(data, deadline)
+	if err == nil {
+		return
+	}
+	httpErr, ok := err.(*HTTPError)
+	if !ok || httpErr.StatusCode != http.StatusRequestEntityTooLarge {
+		if isPermanent(err) {
+			return [][]byte{data}, nil, err
+		}
+		return nil, [][]byte{data}, err
+	}
+	parts, splitErr := splitCompressed(data)
+	if splitErr != nil {
+		log.Printf("Error: can't split payload %v", splitErr)
+		return [][]byte{data}, nil, err
+	}
+	log.Printf("Payload too large, splitting in %d parts", len(parts))
+	err = nil
+	for i, part := range parts {
+		partRejected, partPending, partErr := s.Post(part, deadline)
+		rejected = append(rejected, partRejected...)
+		if len(partPending) > 0 {
+			// The rest is retried later, in order
+			return rejected, append(partPending, parts[i+1:]...), partErr
+		}
+		if partErr != nil {
+			err = partErr
+		}
+	}
+	return
+}
+
+// Send the payload, retrying until it is accepted, a permanent error occurs,
+// or the next attempt would not start before the deadline
+func (s *Sender) postRetry(data []byte, deadline time.Time) (err error) {
+	var requestId string
+
+	for attempt := 1; attempt <= SenderMaxAttempts; attempt++ {
+		requestId, err = s.post(data, deadline)
+		if err == nil {
+			if DebugLog {
+				log.Printf("Metrics api accepted requestId %s", requestId)
+			}
+			return
+		}
+		if isPermanent(err) || attempt == SenderMaxAttempts {
+			break
+		}
+
+		wait := backoff(attempt)
+		if httpErr, ok := err.(*HTTPError); ok && httpErr.RetryAfter > 0 {
+			wait = httpErr.RetryAfter
+		}
+		if time.Now().Add(wait).After(deadline) {
+			log.Printf("Retry %d: %v, no time left before next poll", attempt, err)
+			break
+		}
+		log.Printf("Retry %d: %v, waiting %v", attempt, err, wait)
+		time.Sleep(wait)
+	}
+	return
+}
+
+// Make a single request, the body is rebuilt so every attempt sends the full payload
+func (s *Sender) post(data []byte, deadline time.Time) (requestId string, err error) {
+	var req *http.Request
+	var res *http.Response
+	var b []byte
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	for _, h := range s.headers {
+		params := strings.SplitN(h, ":", 2)
+		req.Header.Set(params[0], params[1])
+	}
+
+	res, err = s.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	b, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	response := apiResponse{}
+	_ = json.Unmarshal(b, &response)
+	requestId = response.RequestId
+
+	if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusAccepted {
+		return
+	}
+	httpErr := &HTTPError{StatusCode: res.StatusCode, RequestId: requestId}
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		httpErr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"))
+	}
+	err = httpErr
+	return
+}
+
+// Exponential backoff with jitter, between half and all of base * 2^(attempt-1)
+func backoff(attempt int) time.Duration {
+	delay := SenderBaseDelay << uint(attempt-1)
+	if delay <= 0 || delay > SenderMaxDelay {
+		delay = SenderMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Retry-After is either a number of seconds or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
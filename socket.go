@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// TCP states in kernel order, the state in /proc/net/tcp is the index plus one
+var tcpStates = []string{
+	"ESTABLISHED", "SYN_SENT", "SYN_RECV", "FIN_WAIT1", "FIN_WAIT2", "TIME_WAIT",
+	"CLOSE", "CLOSE_WAIT", "LAST_ACK", "LISTEN", "CLOSING",
+}
+
+// Socket use from /proc/net/sockstat and sockstat6, with TCP connections counted by state
+// and by local port. Port counts leave out the listening socket itself.
+type SocketSample struct {
+	SocketsUsed     float64 `json:"socketsUsed"`
+	TcpInUse        float64 `json:"socketTcpInUse"`
+	Tcp6InUse       float64 `json:"socketTcp6InUse"`
+	TcpOrphans      float64 `json:"socketTcpOrphans"`
+	TcpTimeWait     float64 `json:"socketTcpTimeWait"`
+	TcpAllocated    float64 `json:"socketTcpAllocated"`
+	TcpMemoryBytes  float64 `json:"socketTcpMemoryBytes"`
+	UdpInUse        float64 `json:"socketUdpInUse"`
+	Udp6InUse       float64 `json:"socketUdp6InUse"`
+	UdpMemoryBytes  float64 `json:"socketUdpMemoryBytes"`
+	TcpStates       map[string]float64
+	PortConnections map[int]float64
+}
+
+type SocketMonitor struct {
+	ports  []int
+	netPid string
+}
+
+func NewSocketMonitor(ports []int, hostRoot string) *SocketMonitor {
+	return &SocketMonitor{ports: ports, netPid: netNamespacePid(hostRoot)}
+}
+
+func (sm *SocketMonitor) Sample() (sample *SocketSample, err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("Panic in SocketMonitor.Sample: %v\nStack: %s", panicErr, debug.Stack())
+		}
+	}()
+
+	sample, err = readSockstat(sm.netPid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every state and port is reported, so a count dropping to zero is seen
+	sample.TcpStates = map[string]float64{}
+	for _, state := range tcpStates {
+		sample.TcpStates[state] = 0
+	}
+	sample.PortConnections = map[int]float64{}
+	for _, port := range sm.ports {
+		sample.PortConnections[port] = 0
+	}
+	err = countTcpConnections(sm.netPid, sample)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
@@ -0,0 +1,11 @@
+package main
+
+import "fmt"
+
+func readSockstat(_ string) (*SocketSample, error) {
+	return nil, fmt.Errorf("socket metrics are not supported on darwin")
+}
+
+func countTcpConnections(_ string, _ *SocketSample) error {
+	return nil
+}
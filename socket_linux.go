@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/newrelic/infrastructure-agent/pkg/helpers"
+)
+
+// Read socket counts of the network namespace of pid, memory is reported by the kernel in pages
+func readSockstat(pid string) (sample *SocketSample, err error) {
+	var v4, v6 map[string]map[string]uint64
+
+	v4, err = parseSockstat(helpers.HostProc(pid, "net", "sockstat"))
+	if err != nil {
+		return
+	}
+	// Kernels without IPv6 have no sockstat6
+	v6, _ = parseSockstat(helpers.HostProc(pid, "net", "sockstat6"))
+
+	sample = &SocketSample{
+		SocketsUsed:    float64(v4["sockets"]["used"]),
+		TcpInUse:       float64(v4["TCP"]["inuse"]),
+		Tcp6InUse:      float64(v6["TCP6"]["inuse"]),
+		TcpOrphans:     float64(v4["TCP"]["orphan"]),
+		TcpTimeWait:    float64(v4["TCP"]["tw"]),
+		TcpAllocated:   float64(v4["TCP"]["alloc"]),
+		TcpMemoryBytes: float64(v4["TCP"]["mem"] * pageSize),
+		UdpInUse:       float64(v4["UDP"]["inuse"]),
+		Udp6InUse:      float64(v6["UDP6"]["inuse"]),
+		UdpMemoryBytes: float64(v4["UDP"]["mem"] * pageSize),
+	}
+	return
+}
+
+// Lines are a protocol then name value pairs, e.g. "TCP: inuse 4 orphan 0 tw 3 alloc 4 mem 0"
+func parseSockstat(filename string) (values map[string]map[string]uint64, err error) {
+	var f *os.File
+
+	f, err = os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	values = map[string]map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		protocol := strings.TrimSuffix(fields[0], ":")
+		values[protocol] = map[string]uint64{}
+		for i := 1; i+1 < len(fields); i += 2 {
+			value, err := strconv.ParseUint(fields[i+1], 10, 64)
+			if err != nil {
+				continue
+			}
+			values[protocol][fields[i]] = value
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+func countTcpConnections(pid string, sample *SocketSample) (err error) {
+	err = parseTcpConnections(helpers.HostProc(pid, "net", "tcp"), sample)
+	if err != nil {
+		return
+	}
+	// Kernels without IPv6 have no tcp6
+	if err = parseTcpConnections(helpers.HostProc(pid, "net", "tcp6"), sample); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// After a header line, each connection looks like
+// "0: 0100007F:1F90 00000000:0000 0A ...", with the local address and port then state in hex
+func parseTcpConnections(filename string, sample *SocketSample) (err error) {
+	var f *os.File
+
+	f, err = os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		state, err := strconv.ParseUint(fields[3], 16, 8)
+		if err != nil || state < 1 || int(state) > len(tcpStates) {
+			continue
+		}
+		name := tcpStates[state-1]
+		sample.TcpStates[name]++
+
+		if name == "LISTEN" || len(sample.PortConnections) == 0 {
+			continue
+		}
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			continue
+		}
+		port, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil {
+			continue
+		}
+		if _, ok := sample.PortConnections[int(port)]; ok {
+			sample.PortConnections[int(port)]++
+		}
+	}
+	err = scanner.Err()
+	return
+}
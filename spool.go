@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const spoolSuffix = ".json.gz"
+
+// Spool keeps compressed payloads on disk while the Metric API is unreachable,
+// bounded by total size and age. Files are named by their creation time, so
+// sorting by name replays them in the order they were stored.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+}
+
+type spoolFile struct {
+	name    string
+	size    int64
+	created time.Time
+}
+
+func NewSpool(dir string, maxBytes int64, maxAge time.Duration) (spool *Spool, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	spool = &Spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge}
+
+	// Payloads left from a previous run are kept, subject to the current limits
+	files, err := spool.files()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		log.Printf("Spool: %d payloads pending from previous run", len(files))
+	}
+	spool.evict(files)
+	return
+}
+
+// List spooled payloads, oldest first
+func (s *Spool) files() (files []spoolFile, err error) {
+	var infos []os.FileInfo
+
+	infos, err = ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		nanos, err := strconv.ParseInt(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, spoolFile{name: name, size: info.Size(), created: time.Unix(0, nanos)})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return
+}
+
+// Remove expired payloads, then the oldest ones until the spool fits in maxBytes.
+// Returns the payloads that remain.
+func (s *Spool) evict(files []spoolFile) (kept []spoolFile) {
+	var total int64
+	var expired, oversized int
+
+	now := time.Now()
+	for _, f := range files {
+		if s.maxAge > 0 && now.Sub(f.created) > s.maxAge {
+			s.remove(f)
+			expired++
+			continue
+		}
+		kept = append(kept, f)
+		total += f.size
+	}
+	for len(kept) > 0 && total > s.maxBytes {
+		s.remove(kept[0])
+		total -= kept[0].size
+		kept = kept[1:]
+		oversized++
+	}
+
+	if expired > 0 {
+		log.Printf("Spool: evicted %d payloads older than %v", expired, s.maxAge)
+	}
+	if oversized > 0 {
+		log.Printf("Spool: evicted %d payloads over the %d byte limit", oversized, s.maxBytes)
+	}
+	return
+}
+
+func (s *Spool) remove(f spoolFile) {
+	err := os.Remove(filepath.Join(s.dir, f.name))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error: spool remove %v", err)
+	}
+}
+
+// Pending reports whether any payloads are waiting to be replayed
+func (s *Spool) Pending() bool {
+	files, err := s.files()
+	return err == nil && len(files) > 0
+}
+
+// Store appends a compressed payload to the spool
+func (s *Spool) Store(b []byte) (err error) {
+	if int64(len(b)) > s.maxBytes {
+		return fmt.Errorf("payload of %d bytes exceeds spool limit of %d bytes", len(b), s.maxBytes)
+	}
+
+	err = s.write(fmt.Sprintf("%020d%s", time.Now().UnixNano(), spoolSuffix), b)
+	if err != nil {
+		return
+	}
+
+	files, err := s.files()
+	if err != nil {
+		return
+	}
+	s.evict(files)
+	return
+}
+
+// Write to a temp file first, so a partial write is never replayed
+func (s *Spool) write(name string, b []byte) (err error) {
+	tmp := filepath.Join(s.dir, name+".tmp")
+	err = ioutil.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return
+}
+
+// Replace a partly delivered payload with the parts still pending, keeping its place and age
+func (s *Spool) replace(f spoolFile, parts [][]byte) (err error) {
+	nanos := f.created.UnixNano()
+	for i, part := range parts {
+		err = s.write(fmt.Sprintf("%020d%s", nanos+int64(i), spoolSuffix), part)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Replay sends spooled payloads oldest first, removing each one once delivered or rejected.
+// It stops at the first transient failure, or when the deadline passes, leaving the rest for later.
+func (s *Spool) Replay(send func([]byte) ([][]byte, [][]byte, error), deadline time.Time) (sent int, err error) {
+	var files []spoolFile
+	var rejected, pending [][]byte
+	var b []byte
+
+	files, err = s.files()
+	if err != nil {
+		return
+	}
+	for _, f := range s.evict(files) {
+		if time.Now().After(deadline) {
+			break
+		}
+		b, err = ioutil.ReadFile(filepath.Join(s.dir, f.name))
+		if err != nil {
+			// Unreadable payload can never be replayed
+			log.Printf("Error: spool read %v", err)
+			s.remove(f)
+			err = nil
+			continue
+		}
+		rejected, pending, err = send(b)
+		if len(pending) == 0 && len(rejected) > 0 {
+			// Rejected parts would block the spool forever, the others were delivered
+			log.Printf("Error: spool dropped %d rejected payloads %v", len(rejected), err)
+			s.remove(f)
+			err = nil
+			continue
+		} else if len(pending) > 0 {
+			if len(pending) != 1 || !bytes.Equal(pending[0], b) {
+				// Only the parts not yet accepted are replayed next time
+				if replaceErr := s.replace(f, pending); replaceErr != nil {
+					log.Printf("Error: spool replace %v", replaceErr)
+				}
+			}
+			break
+		}
+		s.remove(f)
+		sent++
+	}
+	if sent > 0 {
+		log.Printf("Spool: replayed %d payloads", sent)
+	}
+	return
+}
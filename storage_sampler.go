@@ -50,6 +50,7 @@ type BaseSample struct {
 	WriteCountDelta         uint64   `json:"-"`
 	ElapsedSampleDeltaMs    int64    `json:"-"`
 	HasDelta                bool     `json:"-"`
+	MountStatus             string   `json:"mountStatus,omitempty"` // Network filesystems only: ok, stale or unreachable
 }
 
 type PartitionStat struct {
@@ -65,8 +66,43 @@ type IOCountersStat interface {
 	Source() string
 }
 
+// Network filesystems can hang when the server is down, so their usage is read with a timeout
+var networkFileSystems = map[string]bool{
+	"nfs":            true,
+	"nfs4":           true,
+	"cifs":           true,
+	"smb3":           true,
+	"smbfs":          true,
+	"ceph":           true,
+	"glusterfs":      true,
+	"fuse.glusterfs": true,
+	"fuse.sshfs":     true,
+	"9p":             true,
+}
+
+const (
+	MountStatusOk          = "ok"
+	MountStatusStale       = "stale"
+	MountStatusUnreachable = "unreachable"
+)
+
+// Mounts to report, by glob patterns on the mount point, and how long to wait on a network filesystem
+type MountFilter struct {
+	Include      []string
+	Exclude      []string
+	UsageTimeout time.Duration
+}
+
+type usageResult struct {
+	usage *disk.UsageStat
+	err   error
+}
+
 type Sampler struct {
 	partitionsFunc   func(_ bool) ([]PartitionStat, error)
+	hostRoot         string
+	filter           MountFilter
+	pendingUsage     map[string]chan usageResult
 	lastRun          time.Time
 	lastDiskStats    map[string]IOCountersStat
 	lastSamples      sample.EventBatch
@@ -81,42 +117,130 @@ type SampleWrapper interface {
 	CalculateSampleValues(counter, lastStats IOCountersStat, elapsedMs int64) *Sample
 }
 
-func NewSampler(interval time.Duration) *Sampler {
+// NewSampler returns a storage sampler, hostRoot is where the host's / is mounted when running in a container
+func NewSampler(interval time.Duration, filter MountFilter, hostRoot string) *Sampler {
 	return &Sampler{
 		partitionsFunc:   fetchPartitions,
+		hostRoot:         hostRoot,
+		filter:           filter,
+		pendingUsage:     map[string]chan usageResult{},
 		interval:         interval,
-		storageUtilities: NewStorageSampleWrapper(interval),
+		storageUtilities: NewStorageSampleWrapper(interval, len(hostRoot) > 0),
+	}
+}
+
+// A named metric value of a storage sample, nil when the sampler did not compute it
+type storageValue struct {
+	name  string
+	value *float64
+}
+
+// Append every populated field of the sample, with the mount attributes.
+// IO rates and utilization are nil until the second sample, and are skipped rather than sent as 0.
+func (data *ConfigData) appendStorageMetrics(entries []Metric, s *Sample) []Metric {
+	ss := s.BaseSample
+	attributes := map[string]string{
+		"mountPoint":     ss.MountPoint,
+		"device":         ss.Device,
+		"isReadOnly":     ss.IsReadOnly,
+		"fileSystemType": ss.FileSystemType,
+	}
+	values := []storageValue{
+		{"UsedBytes", ss.UsedBytes},
+		{"UsedPercent", ss.UsedPercent},
+		{"FreeBytes", ss.FreeBytes},
+		{"FreePercent", ss.FreePercent},
+		{"TotalBytes", ss.TotalBytes},
+		{"TotalUtilizationPercent", ss.TotalUtilizationPercent},
+		{"ReadUtilizationPercent", ss.ReadUtilizationPercent},
+		{"WriteUtilizationPercent", ss.WriteUtilizationPercent},
+		{"ReadBytesPerSec", ss.ReadBytesPerSec},
+		{"WriteBytesPerSec", ss.WriteBytesPerSec},
+		{"ReadWriteBytesPerSecond", ss.ReadWriteBytesPerSecond},
+		{"ReadsPerSec", ss.ReadsPerSec},
+		{"WritesPerSec", ss.WritesPerSec},
+	}
+	values = append(values, storageValuesOS(s)...)
+
+	if len(ss.MountStatus) > 0 {
+		status := map[string]string{"status": ss.MountStatus}
+		for k, v := range attributes {
+			status[k] = v
+		}
+		var ok float64
+		if ss.MountStatus == MountStatusOk {
+			ok = 1
+		}
+		entries = data.appendMetricAttributes(entries, "DiskMountStatus", ok, status)
+	}
+
+	for _, v := range values {
+		if v.value == nil {
+			continue
+		}
+		entries = data.appendMetricAttributes(entries, "Disk"+v.name, *v.value, attributes)
 	}
+	return entries
 }
 
-func (data *ConfigData) getStorageMetric(sample interface{}, name string) (metric Metric) {
-	var value float64
-	ss := sample.(*Sample).BaseSample
-
-	if name == "UsedBytes" && ss.UsedBytes != nil {
-		value = *ss.UsedBytes
-	} else if name == "UsedPercent" && ss.UsedPercent != nil {
-		value = *ss.UsedPercent
-	} else if name == "FreeBytes" && ss.FreeBytes != nil {
-		value = *ss.FreeBytes
-	} else if name == "FreePercent" && ss.FreePercent != nil {
-		value = *ss.FreePercent
-	} else if name == "TotalBytes" && ss.TotalBytes != nil {
-		value = *ss.TotalBytes
-	} else if name == "ReadBytesPerSec" && ss.ReadBytesPerSec != nil {
-		value = *ss.ReadBytesPerSec
-	} else if name == "WriteBytesPerSec" && ss.WriteBytesPerSec != nil {
-		value = *ss.WriteBytesPerSec
-	} else if name == "ReadWriteBytesPerSecond" && ss.ReadWriteBytesPerSecond != nil {
-		value = *ss.ReadWriteBytesPerSecond
+// Replace the filesystem types storage is reported for
+func setSupportedFileSystems(fsTypes []string) {
+	SupportedFileSystems = map[string]bool{}
+	for _, fsType := range fsTypes {
+		SupportedFileSystems[fsType] = true
 	}
+}
 
-	metric = data.makeMetric("Disk" + name, value)
-	metric["attributes"].(map[string]string)["mountPoint"] = ss.MountPoint
-	metric["attributes"].(map[string]string)["device"] = ss.Device
-	metric["attributes"].(map[string]string)["isReadOnly"] = ss.IsReadOnly
-	metric["attributes"].(map[string]string)["fileSystemType"] = ss.FileSystemType
-	return
+// Excludes win over includes, no include patterns means every mount point
+func (filter MountFilter) match(mountPoint string) bool {
+	if matchMount(filter.Exclude, mountPoint) {
+		return false
+	}
+	return len(filter.Include) == 0 || matchMount(filter.Include, mountPoint)
+}
+
+// A pattern matching a directory also matches the mounts below it, as * does not match /
+func matchMount(patterns []string, mountPoint string) bool {
+	for dir := filepath.Clean(mountPoint); ; dir = filepath.Dir(dir) {
+		if matchAny(patterns, dir) {
+			return true
+		}
+		if dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
+
+// Read usage of a network filesystem without blocking the poll on a hung server.
+// A call that times out is left running, and the mount reports stale until it returns.
+func (ss *Sampler) networkUsage(mountPoint string) (usage *disk.UsageStat, status string) {
+	var result usageResult
+
+	ch, pending := ss.pendingUsage[mountPoint]
+	if pending {
+		select {
+		case result = <-ch:
+		default:
+			return nil, MountStatusStale
+		}
+	} else {
+		ch = make(chan usageResult, 1)
+		go func() {
+			usage, err := ss.storageUtilities.Usage(mountPoint)
+			ch <- usageResult{usage: usage, err: err}
+		}()
+		select {
+		case result = <-ch:
+		case <-time.After(ss.filter.UsageTimeout):
+			ss.pendingUsage[mountPoint] = ch
+			return nil, MountStatusStale
+		}
+	}
+	delete(ss.pendingUsage, mountPoint)
+	if result.err != nil {
+		return nil, MountStatusUnreachable
+	}
+	return result.usage, MountStatusOk
 }
 
 func (p *PartitionStat) IsReadOnly() bool {
@@ -163,13 +287,15 @@ func (ss *Sampler) Sample() (samples sample.EventBatch, err error) {
 		}
 	}()
 
-	partitions, err := ss.partitionsFunc(false)
+	// With a host root, read the mounts of the host's PID 1 rather than our own
+	isContainerized := len(ss.hostRoot) > 0
+	partitions, err := ss.partitionsFunc(isContainerized)
 	if err != nil {
 		log.Println("Error: storageSample can't get partitions")
 		return nil, err
 	}
 
-	var mountPointPrefix string
+	mountPointPrefix := ss.hostRoot
 
 	//make sure we have a set, not a list
 	var activeDevices = map[string]bool{}
@@ -184,10 +310,7 @@ func (ss *Sampler) Sample() (samples sample.EventBatch, err error) {
 		// to collect the disk usage we need to resolve the mount points with the host root prefix.
 		// e.g. "/" -> "/host" and "/data1" -> "/host/data1"
 		mountPoint := filepath.Join(mountPointPrefix, p.Mountpoint)
-
-		fsUsage, err := ss.storageUtilities.Usage(mountPoint)
-		if err != nil {
-			log.Printf("Warning: storageSample - mountPoint %s can't get disk usage, ignoring", mountPoint)
+		if !ss.filter.match(p.Mountpoint) {
 			continue
 		}
 
@@ -197,7 +320,24 @@ func (ss *Sampler) Sample() (samples sample.EventBatch, err error) {
 		s.MountPoint = p.Mountpoint // Ensure we use the reported mount point, not the prefixed one
 		s.Device = p.Device
 		s.IsReadOnly = strconv.FormatBool(p.IsReadOnly())
-		populateUsage(fsUsage, s)
+
+		if networkFileSystems[p.Fstype] {
+			// Stale and unreachable mounts are still reported, with their status and no usage
+			fsUsage, status := ss.networkUsage(mountPoint)
+			s.MountStatus = status
+			if fsUsage != nil {
+				populateUsage(fsUsage, s)
+			} else {
+				log.Printf("Warning: storageSample - network mountPoint %s is %s", mountPoint, status)
+			}
+		} else {
+			fsUsage, err := ss.storageUtilities.Usage(mountPoint)
+			if err != nil {
+				log.Printf("Warning: storageSample - mountPoint %s can't get disk usage, ignoring", mountPoint)
+				continue
+			}
+			populateUsage(fsUsage, s)
+		}
 
 		// we can have multiple mountpoints for the same device
 		dev2Samples[p.Device] = append(dev2Samples[p.Device], s)
@@ -213,7 +353,7 @@ func (ss *Sampler) Sample() (samples sample.EventBatch, err error) {
 	} else {
 		if ss.lastDiskStats != nil {
 			// This can start using a cache at some point
-			deviceToLogical := CalculateDeviceMapping(activeDevices, false)
+			deviceToLogical := CalculateDeviceMapping(activeDevices, isContainerized)
 
 			for deviceKey, counter := range ioCounters {
 				// Check to see whether we have a mapping from device key to device
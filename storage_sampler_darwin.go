@@ -34,11 +34,12 @@ func (d DarwinIoCountersStat) Source() string {
 	return "gopsutil"
 }
 
-func NewStorageSampleWrapper(interval time.Duration) SampleWrapper {
+func NewStorageSampleWrapper(interval time.Duration, isContainerized bool) SampleWrapper {
 	ssw := DarwinStorageSampleWrapper{
 		partitionsCache: PartitionsCache{
-			ttl:            interval,
-			partitionsFunc: fetchPartitions,
+			ttl:             interval,
+			isContainerized: isContainerized,
+			partitionsFunc:  fetchPartitions,
 		},
 	}
 	return &ssw
@@ -113,6 +114,10 @@ func populateSampleOS(_, _ *Sample) {
 	//intentionally left empty, no OS specific values
 }
 
+func storageValuesOS(_ *Sample) []storageValue {
+	return nil
+}
+
 func populateUsageOS(_ *disk.UsageStat, _ *Sample) {
 	//intentionally left empty, no OS specific usage values
 }
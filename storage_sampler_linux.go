@@ -120,11 +120,12 @@ type MountInfoStat struct {
 	Opts        string
 }
 
-func NewStorageSampleWrapper(interval time.Duration) SampleWrapper {
+func NewStorageSampleWrapper(interval time.Duration, isContainerized bool) SampleWrapper {
 	ssw := LinuxStorageSampleWrapper{
 		partitions: PartitionsCache{
-			ttl:            interval,
-			partitionsFunc: fetchPartitions,
+			ttl:             interval,
+			isContainerized: isContainerized,
+			partitionsFunc:  fetchPartitions,
 		},
 	}
 	return &ssw
@@ -143,6 +144,24 @@ func populateUsageOS(fsUsage *disk.UsageStat, dest *Sample) {
 	dest.InodesUsedPercent = &fsUsage.InodesUsedPercent
 }
 
+// Inode counts are only reported on Linux
+func storageValuesOS(s *Sample) []storageValue {
+	return []storageValue{
+		{"InodesUsed", uint64Value(s.InodesUsed)},
+		{"InodesFree", uint64Value(s.InodesFree)},
+		{"InodesTotal", uint64Value(s.InodesTotal)},
+		{"InodesUsedPercent", s.InodesUsedPercent},
+	}
+}
+
+func uint64Value(v *uint64) *float64 {
+	if v == nil {
+		return nil
+	}
+	f := float64(*v)
+	return &f
+}
+
 func CalculateSampleValues(ioCounter IOCountersStat, ioLastStats IOCountersStat, elapsedMs int64) (ioSample *Sample) {
 	counter := ioCounter.(*LinuxIoCountersStat)
 	lastStats := ioLastStats.(*LinuxIoCountersStat)